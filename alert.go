@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// alerter posts a message to a Slack or Discord compatible incoming webhook once updates have failed a number of
+// times in a row, repeating at most once per throttle interval, and again once an update succeeds.
+type alerter struct {
+	URL      *url.URL
+	After    int
+	Throttle time.Duration
+
+	failures  int
+	alerted   bool
+	lastAlert time.Time
+}
+
+// record records the outcome of an update, alerting as needed. A nil alerter does nothing.
+func (a *alerter) record(err error) {
+	if a == nil {
+		return
+	}
+
+	if err == nil {
+		if a.alerted {
+			a.send(fmt.Sprintf("trmnl-wthr-svr is back to normal after %d failed updates", a.failures))
+		}
+		a.failures, a.alerted, a.lastAlert = 0, false, time.Time{}
+		return
+	}
+
+	a.failures++
+	if a.failures < a.After || time.Since(a.lastAlert) < a.Throttle {
+		return
+	}
+	// Alerts go to a third party so don't leak the webhook's plugin ID or API keys in request URLs
+	a.send(fmt.Sprintf("trmnl-wthr-svr has failed %d updates in a row: %s", a.failures, redactErrorURLs(err)))
+	a.alerted, a.lastAlert = true, time.Now()
+}
+
+// send posts text to the alert webhook. Slack reads "text" and Discord reads "content" so both are sent.
+func (a *alerter) send(text string) {
+	body, err := json.Marshal(map[string]string{"text": text, "content": text})
+	if err != nil {
+		slog.Error("could not marshal alert", slog.String("err", err.Error()))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		slog.Error("could not create alert request", slog.String("err", err.Error()))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("could not send alert", slog.String("err", err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		slog.Error("alert webhook request failed", slog.Int("status", resp.StatusCode))
+		return
+	}
+	slog.Info("sent alert", slog.String("text", text))
+}
+
+// redactErrorURLs returns err's message with the URL of every failed request it wraps redacted by redactWebhookURL.
+func redactErrorURLs(err error) string {
+	msg := err.Error()
+	for _, urlErr := range urlErrors(err) {
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+			msg = strings.ReplaceAll(msg, urlErr.URL, redactWebhookURL(u))
+		}
+	}
+	return msg
+}
+
+// urlErrors returns every *url.Error in err's tree, including those joined by errors.Join.
+func urlErrors(err error) []*url.Error {
+	var all []*url.Error
+	if urlErr, ok := err.(*url.Error); ok {
+		all = append(all, urlErr)
+	}
+	switch err := err.(type) {
+	case interface{ Unwrap() error }:
+		all = append(all, urlErrors(err.Unwrap())...)
+	case interface{ Unwrap() []error }:
+		for _, err := range err.Unwrap() {
+			all = append(all, urlErrors(err)...)
+		}
+	}
+	return all
+}
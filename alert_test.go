@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedactErrorURLs(t *testing.T) {
+	webhookErr := fmt.Errorf("error sending webhook request: %w", &url.Error{
+		Op:  "Post",
+		URL: "https://usetrmnl.com/api/custom_plugins/1b2c3d4e-uuid",
+		Err: errors.New("connection reset by peer"),
+	})
+	ambientErr := &url.Error{
+		Op:  "Get",
+		URL: "https://rt.ambientweather.net/v1/devices?apiKey=secret-api&applicationKey=secret-app",
+		Err: errors.New("timeout"),
+	}
+
+	got := redactErrorURLs(errors.Join(webhookErr, ambientErr))
+	for _, secret := range []string{"1b2c3d4e-uuid", "secret-api", "secret-app"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("redactErrorURLs() = %q, leaks %q", got, secret)
+		}
+	}
+	for _, kept := range []string{"usetrmnl.com/api/custom_plugins/xxxxx", "connection reset by peer", "timeout"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("redactErrorURLs() = %q, want it to contain %q", got, kept)
+		}
+	}
+}
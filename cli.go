@@ -1,25 +1,323 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/lrosenman/ambient"
 )
 
 type Globals struct {
-	Debug bool `short:"D" help:"Enable debug mode"`
+	Debug bool `short:"D" help:"Enable debug mode, taking precedence over --quiet"`
+	Quiet bool `short:"q" help:"Only log warnings and errors, unless --debug is given"`
+
+	LocalAddr  string `placeholder:"IP" help:"Local IP address outbound requests originate from, for multi-homed hosts where the source address matters"`
+	StatsdAddr string `placeholder:"HOST:PORT" help:"StatsD UDP address to send update, Ambient Weather API and webhook metrics to"`
+
+	AmbientTimeout time.Duration `required:"false" default:"30s" help:"How long to wait for an Ambient Weather API request before giving up"`
+}
+
+// Validate checks that the local address, if given, is an IP address.
+func (g *Globals) Validate() error {
+	if g.LocalAddr != "" && net.ParseIP(g.LocalAddr) == nil {
+		return fmt.Errorf("invalid local address %q, expected an IPv4 or IPv6 address", g.LocalAddr)
+	}
+	return nil
 }
 
 type CLI struct {
 	Globals
 
-	Server ServerCmd `cmd:"" help:"Run the webhook server"`
+	Server     ServerCmd     `cmd:"" help:"Run the webhook server"`
+	Serve      ServeCmd      `cmd:"" help:"Serve webhook data over HTTP for TRMNL polling plugins"`
+	Synthetic  SyntheticCmd  `cmd:"" help:"Send generated weather data to the webhook without calling Ambient Weather"`
+	Template   TemplateCmd   `cmd:"" help:"Print a reference TRMNL template using the merge variables sent to the webhook"`
+	Devices    DevicesCmd    `cmd:"" help:"List the Ambient Weather devices available to the API keys"`
+	ListFields ListFieldsCmd `cmd:"" help:"List the fields the device reports in its latest data, with their values and types"`
+}
+
+// AmbientKeyFlags are the Ambient Weather API key flags shared by every command that calls the API.
+type AmbientKeyFlags struct {
+	ApplicationKey string `required:"true" help:"Ambient Weather API 'application' key"`
+	APIKey         string `required:"true" help:"Ambient Weather API key"`
+}
+
+// Key returns the Ambient Weather API key pair.
+func (f AmbientKeyFlags) Key() ambient.Key {
+	return ambient.NewKey(f.ApplicationKey, f.APIKey)
+}
+
+// AmbientFlags are the Ambient Weather API flags shared by every command that fetches station data.
+type AmbientFlags struct {
+	AmbientKeyFlags
+
+	Device          string `required:"true" xor:"device" help:"Ambient Weather Device MAC address"`
+	DeviceNameMatch string `required:"true" xor:"device" help:"Ambient Weather Device name, as configured in the Ambient Weather app, used to look up its MAC address"`
+}
+
+// ResolveDevice sets Device to the MAC address of the device named by DeviceNameMatch, if given.
+func (f *AmbientFlags) ResolveDevice(ctx context.Context) error {
+	if f.DeviceNameMatch == "" {
+		return nil
+	}
+	mac, err := DeviceMacByName(ctx, f.Key(), f.DeviceNameMatch)
+	if err != nil {
+		return err
+	}
+	f.Device = mac
+
+	// Give the rate limit a chance to reset before the device is queried again
+	return sleep(ctx, ambientRateLimitWindow)
+}
+
+// DataFlags control how Ambient Weather data is shaped into merge variables.
+type DataFlags struct {
+	ResultsLimit               int64          `required:"false" default:"288" help:"Ambient Weather maximum number of historical results to return"`
+	MaxProcessRecords          int            `required:"false" default:"10000" help:"Maximum number of the most recent historical records processed, protecting memory if the API returns more than requested"`
+	HistoricalRefresh          time.Duration  `help:"Only fetch historical data this often, e.g. 1h, reusing it for the updates in between, rather than with every update"`
+	BucketInterval             time.Duration  `xor:"bucketing" placeholder:"1h" help:"Time interval historical data is averaged over, hourly when not set"`
+	HistoricalPoints           uint           `xor:"bucketing" help:"Average historical data over whatever interval produces roughly this many evenly spaced points"`
+	BucketTimestamp            string         `required:"false" default:"start" enum:"start,first-sample" help:"Historical dateutc is the start of the bucket interval, e.g. the top of the hour, or the timestamp of its earliest sample (${enum})"`
+	HistoricalLayout           string         `required:"false" default:"objects" enum:"objects,columns" help:"Send historical data as an array of records (objects) or as parallel arrays per field, e.g. {\"dateutc\": [...], \"tempf\": [...]} (columns) (${enum})"`
+	HistoricalOrder            string         `required:"false" default:"asc" enum:"asc,desc" help:"Order historical data by timestamp, oldest first (asc) or newest first (desc) (${enum})"`
+	HistoricalRaw              bool           `help:"Also send the unaggregated historical tempf and dateutc as historicalRaw, e.g. to check what bucketing hides"`
+	HistoricalRawMax           int            `required:"false" default:"288" help:"Maximum number of the most recent records sent as historicalRaw"`
+	FineWindow                 time.Duration  `help:"Also send historicalCoarse over the full window and historicalFine over this trailing window, e.g. 3h, for zoomed out and zoomed in graphs"`
+	FineInterval               time.Duration  `required:"false" default:"15m" help:"Time interval historicalFine data is averaged over"`
+	CoarseInterval             time.Duration  `required:"false" default:"3h" help:"Time interval historicalCoarse data is averaged over"`
+	PrimaryTempField           string         `required:"false" default:"tempf" help:"Field used as the outdoor temperature, tempf, everywhere, e.g. temp1f for an add-on sensor"`
+	FeelsLikeModel             string         `required:"false" default:"ambient" enum:"ambient,heat-index,wind-chill,apparent" help:"How the feels like temperature is computed (${enum}). 'ambient' uses the station provided value"`
+	SuppressRedundantFeelslike bool           `help:"Drop feelsLike from the latest data when it's within --feelslike-delta of tempf, e.g. on mild days"`
+	FeelslikeDelta             float64        `required:"false" default:"0.5" help:"Difference in °F from tempf within which feelsLike is redundant, see --suppress-redundant-feelslike"`
+	Indoor                     bool           `help:"Include the indoor sensor tempinf and humidityin fields in the latest data"`
+	IndoorNamespace            bool           `help:"Nest indoor sensor fields under 'indoor' using outdoor field names, e.g. indoor.tempf"`
+	LatestAverage              time.Duration  `xor:"smoothing" help:"Average the latest readings over this trailing window of historical records, e.g. 10m, rather than using the single latest reading"`
+	LatestEmaAlpha             float64        `xor:"smoothing" placeholder:"ALPHA" help:"Smooth the latest readings with an exponential moving average over historical records, weighting each newer reading by this alpha between 0 and 1. An alpha of 2/(N+1) smooths about as much as averaging the last N readings, e.g. 0.33 for 5"`
+	TimeWeighted               bool           `help:"Weight each historical sample by the time until the next one when averaging, for irregularly reporting stations"`
+	MinBucketSamples           int            `required:"false" default:"1" help:"Drop historical buckets averaging fewer than this many samples"`
+	MaxBuckets                 int            `help:"Only send the most recent this many historical buckets, 0 sends them all"`
+	MinHistorical              int            `required:"false" default:"0" help:"Pad historical data with the latest reading when there are fewer than this many averaged records"`
+	RainTotals                 bool           `help:"Include the weeklyrainin, monthlyrainin and yearlyrainin rain totals in the latest data"`
+	RainHour                   bool           `help:"Send rainHour, the inches of rain that fell during each historical bucket, e.g. for an hourly rain chart, computed from increases in dailyrainin"`
+	FahrenheitAndCelsius       bool           `help:"Also send a Celsius equivalent of each temperature field in the latest and historical data, e.g. tempc alongside tempf and feelsLikeC alongside feelsLike"`
+	WindUnits                  bool           `help:"Also send km/h, m/s and knots equivalents of each wind speed field in the latest and historical data, e.g. windspeedkmh, windspeedms and windspeedknots alongside windspeedmph"`
+	IncludeField               []string       `help:"Additional field to include in the latest data and historical averages, may be repeated"`
+	ExcludeField               []string       `help:"Field to exclude from the latest data and historical averages, may be repeated and takes precedence over included fields"`
+	ConditionsSummary          bool           `help:"Send conditions, a short summary of the latest reading like \"Day, dry, 72°F, light breeze\", composed from whichever of the time of day, hourlyrainin, tempf and windspeedmph are known"`
+	Latitude                   *float64       `and:"coordinates" help:"Station latitude in degrees, used with --longitude to compute sunrise and sunset"`
+	Longitude                  *float64       `and:"coordinates" help:"Station longitude in degrees, east positive, used with --latitude to compute sunrise and sunset"`
+	Timezone                   string         `required:"false" default:"UTC" help:"IANA timezone, e.g. America/New_York, used for local times and days"`
+	LocalTimestamps            bool           `help:"Also send each latest and historical dateutc as datelocal, an ISO 8601 time with offset in --timezone"`
+	DefaultPrecision           int            `required:"false" default:"1" help:"Decimal places computed values, e.g. averages, are rounded to"`
+	Precision                  map[string]int `mapsep:"," placeholder:"FIELD=PLACES,..." help:"Decimal places to round a field to, overriding --default-precision, e.g. tempf=1,baromrelin=2. Station values are only rounded when listed"`
+	IntegerField               []string       `help:"Field to send as a whole number, e.g. humidity, in the latest and historical data, may be repeated"`
+	Rounding                   string         `required:"false" default:"nearest" enum:"nearest,floor,ceil" help:"How values are rounded for output (${enum})"`
+	DumpAmbient                string         `type:"path" placeholder:"DIR" help:"Directory to save raw Ambient Weather API responses to, one timestamped file per request"`
+	DebugSampleRecords         int            `required:"false" default:"10" help:"Number of historical records to log at debug level, 0 logs none"`
+	DebugSampleFrom            string         `required:"false" default:"end" enum:"start,middle,end" help:"Where in the historical records the debug sample is taken from (${enum})"`
+	DegreeBase                 *float64       `placeholder:"65" help:"Base temperature in °F to compute heating, or cooling, degree hours over the historical window from"`
+	DegreeMode                 string         `required:"false" default:"heating" enum:"heating,cooling" help:"Whether degree hours count time below the base (heating) or above it (cooling) (${enum})"`
+	StaleAfter                 time.Duration  `required:"false" default:"30m" help:"Age after which the latest reading is flagged as stale, e.g. when the station is offline"`
+	EmptyRetries               int            `required:"false" default:"2" help:"How many times to retry when the Ambient Weather API returns zero device records, often a transient hiccup"`
+	EmptyRetryDelay            time.Duration  `required:"false" default:"2s" help:"Delay between retries of zero device record responses, at least the API rate limit window"`
+	DeviceInfo                 bool           `help:"Send the station's name and location, as configured in the Ambient Weather app, as meta.deviceName and meta.deviceLocation"`
+	PartialOK                  bool           `help:"Send whichever of the latest or historical data could be fetched when the other fails, flagging the data as partial"`
+}
+
+// Validate checks that the timezone is a known IANA timezone so a typo fails fast rather than silently using UTC, and
+// that the EMA alpha, if given, is in range.
+func (f *DataFlags) Validate() error {
+	if f.LatestEmaAlpha < 0 || f.LatestEmaAlpha > 1 {
+		return fmt.Errorf("invalid --latest-ema-alpha %v, expected a value between 0 and 1", f.LatestEmaAlpha)
+	}
+	if _, err := time.LoadLocation(f.Timezone); err != nil {
+		return fmt.Errorf("invalid --timezone %q, expected an IANA timezone like America/New_York or Europe/London: %w", f.Timezone, err)
+	}
+	return nil
+}
+
+// location returns the configured timezone's location. Validate has already checked that it loads so failing to
+// here means Validate was skipped, which is a bug rather than something to paper over with UTC.
+func (f *DataFlags) location() *time.Location {
+	location, err := time.LoadLocation(f.Timezone)
+	if err != nil {
+		panic(fmt.Sprintf("unvalidated --timezone %q: %v", f.Timezone, err))
+	}
+	return location
+}
+
+// PayloadFlags control how data is encoded for TRMNL.
+type PayloadFlags struct {
+	PayloadShape string `required:"false" default:"wrapped" enum:"wrapped,bare" help:"Payload shape (${enum}). 'wrapped' nests data under merge_variables as private plugin webhooks expect, 'bare' sends the merge variables alone"`
+	Schema       string `required:"false" default:"merge-variables" enum:"merge-variables,trmnl-fields" help:"Payload schema (${enum}). 'trmnl-fields' sends the latest reading as a flat list of label and value fields"`
+}
+
+// PayloadFormat returns the payload format configured by the flags.
+func (f PayloadFlags) PayloadFormat() payloadFormat {
+	return payloadFormat{Shape: f.PayloadShape, Schema: f.Schema}
+}
+
+// WebhookFlags configure how data is sent to the TRMNL webhook.
+type WebhookFlags struct {
+	PayloadFlags
+
+	WebhookUrl    *url.URL          `help:"TRMNL private plugin webhook URL, required unless --output-file is given. A receiver listening on a Unix domain socket is given like unix:///path/to/socket:/path"`
+	Byos          bool              `name:"byos" help:"The webhook URL is a self-hosted BYOS server's, e.g. https://trmnl.local/api/custom_plugins/<id>/merge_variables, rather than TRMNL cloud's https://usetrmnl.com/api/custom_plugins/<uuid>"`
+	WebhookMethod string            `required:"false" default:"POST" enum:"POST,PUT,PATCH" help:"HTTP method used to send data to the webhook URL (${enum})"`
+	WebhookQuery  map[string]string `help:"Query parameter to add to the webhook URL, overriding any already present, e.g. token=abc123, may be repeated"`
+
+	PayloadEncoding string `required:"false" default:"json" enum:"json,form" help:"How the payload is sent (${enum}). 'form' sends the JSON as a 'payload' form value for legacy receivers"`
+
+	WebhookRetries    int           `required:"false" default:"3" help:"How many times to retry transient webhook connection errors, e.g. DNS timeouts or connection resets"`
+	WebhookRetryDelay time.Duration `required:"false" default:"1s" help:"Delay before the first webhook retry, doubling for each retry after"`
+	RetryRefetch      bool          `help:"Fetch fresh data before each webhook retry rather than resending the original payload"`
+	IdempotencyKey    bool          `default:"true" negatable:"" help:"Send an Idempotency-Key header, the same for every attempt of an update, so the receiver can drop retried duplicates"`
+
+	PostWhen []condition `placeholder:"FIELD<VALUE" help:"Only send data when the latest reading meets this condition, e.g. tempf<32, may be repeated and all must be met. Supports <, <=, >, >=, == and !="`
+
+	BlockPrivateWebhook bool `help:"Refuse to send to a webhook URL whose host resolves to a private, loopback or link-local address, e.g. when the URL is user supplied in a shared environment"`
+
+	WebhookCaFile string `type:"existingfile" help:"PEM bundle of certificate authorities to trust for the webhook URL instead of the system's, e.g. for a private CA"`
+
+	DumpPayloadOnError string `type:"path" placeholder:"DIR" help:"Directory to save payloads the webhook rejects to, with the response status and body, one timestamped pair of files per rejection"`
+
+	OutputFile string `type:"path" help:"File to atomically write the payload to each update, instead of sending it when no webhook URL is given"`
+}
+
+// Validate checks that there's somewhere to send data to and that the webhook CA file, if given, can be loaded.
+func (f *WebhookFlags) Validate() error {
+	if f.WebhookUrl == nil && f.OutputFile == "" {
+		return errors.New("missing flags: --webhook-url or --output-file")
+	}
+	if f.WebhookUrl != nil && f.WebhookUrl.Scheme == unixSocketScheme {
+		if _, _, err := parseUnixSocketURL(f.WebhookUrl); err != nil {
+			return err
+		}
+	}
+	if f.WebhookCaFile != "" {
+		if _, err := loadCertPool(f.WebhookCaFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Webhook returns a Webhook configured from the flags, warning when its URL doesn't look like a TRMNL webhook URL.
+func (f WebhookFlags) Webhook() *Webhook {
+	if f.WebhookUrl == nil {
+		return &Webhook{Format: f.PayloadFormat(), PostWhen: f.PostWhen, OutputFile: f.OutputFile}
+	}
+	unixSocket := f.WebhookUrl.Scheme == unixSocketScheme
+	if err := checkWebhookURL(f.WebhookUrl, f.Byos); err != nil && !unixSocket {
+		slog.Warn("unexpected webhook URL", slog.String("url", f.WebhookUrl.String()), slog.String("err", err.Error()))
+	}
+	client := http.DefaultClient
+	if f.WebhookCaFile != "" {
+		// Already loaded once by Validate so this only fails if the file changed since
+		pool, err := loadCertPool(f.WebhookCaFile)
+		if err != nil {
+			slog.Error("could not load webhook CA file, using system CAs", slog.String("err", err.Error()))
+		} else {
+			client = clientWithRootCAs(pool)
+		}
+	}
+	webhookURL := f.webhookURL()
+	if unixSocket {
+		// Already parsed once by Validate so this can't fail
+		socket, socketURL, _ := parseUnixSocketURL(webhookURL)
+		client, webhookURL = unixSocketClient(client, socket), socketURL
+	}
+	if f.BlockPrivateWebhook {
+		client = blockPrivateAddrs(client)
+	}
+	return &Webhook{
+		Client:             client,
+		URL:                webhookURL,
+		Method:             f.WebhookMethod,
+		Format:             f.PayloadFormat(),
+		Encoding:           f.PayloadEncoding,
+		Retries:            f.WebhookRetries,
+		RetryDelay:         f.WebhookRetryDelay,
+		IdempotencyKey:     f.IdempotencyKey,
+		DumpPayloadOnError: f.DumpPayloadOnError,
+		PostWhen:           f.PostWhen,
+		OutputFile:         f.OutputFile,
+	}
+}
+
+// webhookURL returns the webhook URL with any query parameters from the flags added.
+func (f WebhookFlags) webhookURL() *url.URL {
+	if len(f.WebhookQuery) == 0 {
+		return f.WebhookUrl
+	}
+	u := *f.WebhookUrl
+	query := u.Query()
+	for key, value := range f.WebhookQuery {
+		query.Set(key, value)
+	}
+	u.RawQuery = query.Encode()
+	return &u
 }
 
 type ServerCmd struct {
-	ApplicationKey string        `required:"true" help:"Ambient Weather API 'application' key"`
-	APIKey         string        `required:"true" help:"Ambient Weather API key"`
-	Device         string        `required:"true" help:"Ambient Weather Device MAC address"`
-	ResultsLimit   int64         `required:"false" default:"288" help:"Ambient Weather maximum number of historical results to return"`
-	WebhookUrl     *url.URL      `required:"true" help:"TRMNL private plugin webhook URL"`
-	Interval       time.Duration `required:"false" default:"15m" help:"Time interval between data updates"`
+	AmbientFlags
+	DataFlags
+	WebhookFlags
+
+	DeltaOnly    bool          `help:"Only send latest fields which changed since the last successful update, relying on TRMNL to deep merge the rest"`
+	Interval     time.Duration `required:"false" default:"15m" help:"Time interval between data updates, 0 runs a single update and exits"`
+	AutoInterval bool          `help:"Detect how often the station reports on startup and update that often instead of --interval, no more than once a minute"`
+	WarmupDelay  time.Duration `help:"Wait this long before the first update, e.g. for networking to settle after a container starts"`
+	MaxBackoff   time.Duration `required:"false" default:"2h" help:"Maximum time interval between data updates while backing off after consecutive failures"`
+
+	VerifyWebhook bool `help:"Send a harmless empty payload to the webhook URL on startup and exit if it fails, to catch a misconfigured webhook before the first update. Skipped for the bare payload shape"`
+
+	MaintenanceBackoff time.Duration `required:"false" default:"30m" help:"Time interval between data updates while the Ambient Weather API is down for maintenance"`
+
+	AlertWebhook  *url.URL      `help:"Slack or Discord compatible incoming webhook URL to alert when updates keep failing, and when they recover"`
+	AlertAfter    int           `required:"false" default:"3" help:"Consecutive failed updates before alerting"`
+	AlertThrottle time.Duration `required:"false" default:"1h" help:"Minimum time between repeated alerts during the same outage"`
+}
+
+// Validate validates both the data and webhook flags, whose Validate methods are ambiguous when embedded together.
+func (c *ServerCmd) Validate() error {
+	return errors.Join(c.DataFlags.Validate(), c.WebhookFlags.Validate())
+}
+
+type ServeCmd struct {
+	AmbientFlags
+	DataFlags
+	PayloadFlags
+
+	Listen      string        `required:"false" default:":8080" help:"Address to listen on for webhook data requests"`
+	CacheTTL    time.Duration `required:"false" default:"5m" help:"How long fetched data is reused before fetching again"`
+	CacheMaxAge time.Duration `help:"Maximum age of cached data, by its latest reading, served when fetching fresh data fails, unlimited when 0"`
+}
+
+type SyntheticCmd struct {
+	DataFlags
+	WebhookFlags
+
+	Seed uint64 `required:"false" default:"0" help:"Random seed for reproducible data, 0 picks a random seed"`
+}
+
+// Validate validates both the data and webhook flags, whose Validate methods are ambiguous when embedded together.
+func (c *SyntheticCmd) Validate() error {
+	return errors.Join(c.DataFlags.Validate(), c.WebhookFlags.Validate())
+}
+
+type TemplateCmd struct{}
+
+type DevicesCmd struct {
+	AmbientKeyFlags
+}
+
+type ListFieldsCmd struct {
+	AmbientFlags
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// conditionPattern matches a comparison of a latest field to a number, e.g. tempf<32 or humidity>=90.
+var conditionPattern = regexp.MustCompile(`^\s*(\w+)\s*(<=|>=|==|!=|<|>)\s*(-?[0-9.]+)\s*$`)
+
+// condition compares a latest field to a number, parsed from a flag value like "tempf<32".
+type condition struct {
+	Field string
+	Op    string
+	Value float64
+}
+
+func (c *condition) UnmarshalText(text []byte) error {
+	match := conditionPattern.FindStringSubmatch(string(text))
+	if match == nil {
+		return fmt.Errorf("invalid condition %q, expected a field, comparison and number, e.g. tempf<32", text)
+	}
+	value, err := strconv.ParseFloat(match[3], 64)
+	if err != nil {
+		return fmt.Errorf("invalid condition %q: %w", text, err)
+	}
+	*c = condition{Field: match[1], Op: match[2], Value: value}
+	return nil
+}
+
+func (c condition) String() string {
+	return c.Field + c.Op + strconv.FormatFloat(c.Value, 'f', -1, 64)
+}
+
+// holds reports whether the condition is true for fields. It is false when the field is missing or not a number.
+func (c condition) holds(fields map[string]any) bool {
+	value, ok := float64Field(fields, c.Field)
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case "<":
+		return value < c.Value
+	case "<=":
+		return value <= c.Value
+	case ">":
+		return value > c.Value
+	case ">=":
+		return value >= c.Value
+	case "==":
+		return value == c.Value
+	case "!=":
+		return value != c.Value
+	default:
+		return false
+	}
+}
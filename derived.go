@@ -0,0 +1,538 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Feels like temperature models selectable with --feels-like-model.
+const (
+	feelsLikeAmbient   = "ambient"
+	feelsLikeHeatIndex = "heat-index"
+	feelsLikeWindChill = "wind-chill"
+	feelsLikeApparent  = "apparent"
+)
+
+// Degree hour modes selectable with --degree-mode.
+const (
+	degreeModeHeating = "heating"
+	degreeModeCooling = "cooling"
+)
+
+// batteryFields maps each Ambient Weather battery indicator field to the value which means its battery is low. Most
+// sensors report 1 for OK and 0 for low but the lightning and leak detectors report the opposite.
+var batteryFields = func() map[string]float64 {
+	fields := map[string]float64{
+		"battout":        0,
+		"battin":         0,
+		"batt_25":        0,
+		"batt_25in":      0,
+		"batt_co2":       0,
+		"batt_lightning": 1,
+	}
+	for i := 1; i <= 10; i++ {
+		fields["batt"+strconv.Itoa(i)] = 0
+		fields["battr"+strconv.Itoa(i)] = 0
+	}
+	for i := 1; i <= 4; i++ {
+		fields["battsm"+strconv.Itoa(i)] = 0
+		fields["batleak"+strconv.Itoa(i)] = 1
+	}
+	return fields
+}()
+
+// isBatteryField reports whether field is an Ambient Weather battery indicator, see batteryFields.
+func isBatteryField(field string) bool {
+	_, ok := batteryFields[field]
+	return ok
+}
+
+// derive computes merge variables derived from the latest and historical data. lastData is the unfiltered latest
+// reading, for values which need fields that aren't necessarily sent, e.g. windspeedmph for wind chill.
+func derive(ctx context.Context, mv *MergeVariables, lastData map[string]any, opts *DataFlags) {
+	mv.BatteryLow = batteryLow(mv.Latest)
+	mv.TimeSinceRain = timeSince(mv.Latest, "lastRain", time.Now())
+
+	mv.DataAgeSeconds = timeSince(mv.Latest, "dateutc", time.Now())
+	if mv.DataAgeSeconds != nil {
+		stale := time.Duration(*mv.DataAgeSeconds)*time.Second > opts.StaleAfter
+		mv.Stale = &stale
+	}
+
+	// The sent latest values, e.g. averaged or with --primary-temp-field, take precedence over the unfiltered ones
+	reading := make(map[string]any, len(lastData)+len(mv.Latest))
+	maps.Copy(reading, lastData)
+	maps.Copy(reading, mv.Latest)
+	if value, ok := windChillField(reading); ok {
+		rounded := opts.round("windChill", value)
+		mv.WindChill = &rounded
+	}
+	if value, ok := heatIndexField(reading); ok {
+		rounded := opts.round("heatIndex", value)
+		mv.HeatIndex = &rounded
+	}
+
+	mv.ComfortLevel = comfortLevel(mv.Latest)
+
+	if opts.Latitude != nil && opts.Longitude != nil {
+		now := time.Now().In(opts.location())
+		sunrise, sunset, daytime, ok := sunTimes(now, *opts.Latitude, *opts.Longitude)
+		if ok {
+			mv.Sunrise = sunrise.Format(time.RFC3339)
+			mv.Sunset = sunset.Format(time.RFC3339)
+		}
+		mv.IsDaytime = &daytime
+	}
+
+	if opts.ConditionsSummary {
+		// Wind and rain aren't forwarded by default so summarize the unfiltered reading
+		mv.Conditions = conditionsSummary(reading, mv.IsDaytime)
+	}
+}
+
+// timeSince returns the number of whole seconds between the named time field and now, or nil when it's missing.
+func timeSince(fields map[string]any, field string, now time.Time) *int64 {
+	t, ok := timeField(fields, field)
+	if !ok {
+		return nil
+	}
+	seconds := int64(max(now.Sub(t), 0) / time.Second)
+	return &seconds
+}
+
+// batteryLow reports whether any battery indicator in fields is low, or nil when there are no battery indicators.
+func batteryLow(fields map[string]any) *bool {
+	var found, low bool
+	for field := range fields {
+		lowValue, ok := batteryFields[field]
+		if !ok {
+			continue
+		}
+		value, ok := float64Field(fields, field)
+		if !ok {
+			continue
+		}
+		found = true
+		low = low || value == lowValue
+	}
+	if !found {
+		return nil
+	}
+	return &low
+}
+
+// float64Field returns the named field from Ambient Weather data as a float64.
+func float64Field(fields map[string]any, field string) (float64, bool) {
+	switch v := fields[field].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(v)), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// missingField reports whether the named field is absent from Ambient Weather data or is empty, as opposed to present
+// but malformed.
+func missingField(fields map[string]any, field string) bool {
+	switch v := fields[field].(type) {
+	case nil:
+		return true
+	case json.Number:
+		return strings.TrimSpace(string(v)) == ""
+	case string:
+		return strings.TrimSpace(v) == ""
+	default:
+		return false
+	}
+}
+
+// timestampField returns the named millisecond timestamp field, e.g. dateutc, from Ambient Weather data as an int64.
+func timestampField(fields map[string]any, field string) (int64, bool) {
+	// Parse timestamp more efficiently
+	switch v := fields[field].(type) {
+	case float64:
+		return int64(v), true
+	case int64:
+		return v, true
+	case json.Number:
+		ms, err := strconv.ParseInt(strings.TrimSpace(string(v)), 10, 64)
+		return ms, err == nil
+	case string:
+		ms, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		return ms, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// timeField returns the named time field from Ambient Weather data, which may either be a millisecond timestamp like
+// dateutc or an ISO 8601 string like lastRain.
+func timeField(fields map[string]any, field string) (time.Time, bool) {
+	if ms, ok := timestampField(fields, field); ok {
+		return time.UnixMilli(ms).UTC(), true
+	}
+	s, ok := fields[field].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t.UTC(), err == nil
+}
+
+// feelsLike computes the feels like temperature in °F from the raw device fields using the given model.
+// The boolean result is false for the "ambient" model, which defers to the station provided value, or when the
+// fields required by the model are missing.
+func feelsLike(model string, fields map[string]any) (float64, bool) {
+	tempf, ok := float64Field(fields, "tempf")
+	if !ok {
+		return 0, false
+	}
+
+	switch model {
+	case feelsLikeHeatIndex:
+		humidity, ok := float64Field(fields, "humidity")
+		if !ok {
+			return 0, false
+		}
+		return heatIndex(tempf, humidity), true
+	case feelsLikeWindChill:
+		windspeedmph, ok := float64Field(fields, "windspeedmph")
+		if !ok {
+			return 0, false
+		}
+		return windChill(tempf, windspeedmph), true
+	case feelsLikeApparent:
+		humidity, hasHumidity := float64Field(fields, "humidity")
+		windspeedmph, hasWind := float64Field(fields, "windspeedmph")
+		if !hasHumidity || !hasWind {
+			return 0, false
+		}
+		return apparentTemperature(tempf, humidity, windspeedmph), true
+	default:
+		return 0, false
+	}
+}
+
+// windChillField returns the wind chill of the fields' tempf and windspeedmph, only when it's cold and windy enough
+// for wind chill to apply, i.e. at or below 50°F with at least 3 mph of wind.
+func windChillField(fields map[string]any) (float64, bool) {
+	tempf, hasTemp := float64Field(fields, "tempf")
+	windspeedmph, hasWind := float64Field(fields, "windspeedmph")
+	if !hasTemp || !hasWind || tempf > 50 || windspeedmph < 3 {
+		return 0, false
+	}
+	return windChill(tempf, windspeedmph), true
+}
+
+// heatIndexField returns the heat index of the fields' tempf and humidity, only when it's hot enough for the heat
+// index to apply, i.e. at or above 80°F.
+func heatIndexField(fields map[string]any) (float64, bool) {
+	tempf, hasTemp := float64Field(fields, "tempf")
+	humidity, hasHumidity := float64Field(fields, "humidity")
+	if !hasTemp || !hasHumidity || tempf < 80 {
+		return 0, false
+	}
+	return heatIndex(tempf, humidity), true
+}
+
+// conditionsSummary composes a short human summary of the fields, e.g. "Day, dry, 72°F, light breeze", from these
+// parts in order, each omitted when the fields it's from aren't reported:
+//
+//	time of day  Day or Night, from daytime when the coordinates are known
+//	rain         heavy rain at 0.3 in/hr or more, rain above 0, otherwise dry, from hourlyrainin
+//	temperature  tempf rounded to a whole degree
+//	wind         calm below 1 mph, light breeze below 8, breeze below 19, windy below 32, otherwise gale, from
+//	             windspeedmph
+//
+// It returns "" when none of the parts can be composed.
+func conditionsSummary(fields map[string]any, daytime *bool) string {
+	var parts []string
+	if daytime != nil {
+		parts = append(parts, map[bool]string{true: "day", false: "night"}[*daytime])
+	}
+
+	if rate, ok := float64Field(fields, "hourlyrainin"); ok {
+		switch {
+		case rate >= 0.3:
+			parts = append(parts, "heavy rain")
+		case rate > 0:
+			parts = append(parts, "rain")
+		default:
+			parts = append(parts, "dry")
+		}
+	}
+
+	if tempf, ok := float64Field(fields, "tempf"); ok {
+		parts = append(parts, strconv.FormatInt(int64(math.Round(tempf)), 10)+"°F")
+	}
+
+	if mph, ok := float64Field(fields, "windspeedmph"); ok {
+		switch {
+		case mph < 1:
+			parts = append(parts, "calm")
+		case mph < 8:
+			parts = append(parts, "light breeze")
+		case mph < 19:
+			parts = append(parts, "breeze")
+		case mph < 32:
+			parts = append(parts, "windy")
+		default:
+			parts = append(parts, "gale")
+		}
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	summary := strings.Join(parts, ", ")
+	return strings.ToUpper(summary[:1]) + summary[1:]
+}
+
+// Comfort levels, see comfortLevel.
+const (
+	comfortCold        = "cold"
+	comfortHot         = "hot"
+	comfortMuggy       = "muggy"
+	comfortDry         = "dry"
+	comfortComfortable = "comfortable"
+)
+
+// comfortLevel labels how comfortable the fields' tempf and humidity feel, or returns "" without them. The first
+// matching row of this matrix applies:
+//
+//	cold         below 50°F
+//	hot          heat index of 90°F or more
+//	muggy        dew point of 65°F or more
+//	dry          humidity below 30%
+//	comfortable  otherwise
+func comfortLevel(fields map[string]any) string {
+	tempf, hasTemp := float64Field(fields, "tempf")
+	humidity, hasHumidity := float64Field(fields, "humidity")
+	if !hasTemp || !hasHumidity {
+		return ""
+	}
+
+	switch {
+	case tempf < 50:
+		return comfortCold
+	case heatIndex(tempf, humidity) >= 90:
+		return comfortHot
+	case dewPoint(tempf, humidity) >= 65:
+		return comfortMuggy
+	case humidity < 30:
+		return comfortDry
+	default:
+		return comfortComfortable
+	}
+}
+
+// dewPoint approximates the dew point in °F from the temperature and relative humidity using the Magnus formula.
+func dewPoint(tempf, humidity float64) float64 {
+	const b, c = 17.62, 243.12
+	tempc := fahrenheitToCelsius(tempf)
+	gamma := math.Log(max(humidity, 1)/100) + b*tempc/(c+tempc)
+	return celsiusToFahrenheit(c * gamma / (b - gamma))
+}
+
+// heatIndex computes the US National Weather Service heat index in °F.
+// The simple Steadman formula is used below 80°F, above which the Rothfusz regression and its adjustments apply.
+// See https://www.wpc.ncep.noaa.gov/html/heatindex_equation.shtml
+func heatIndex(tempf, humidity float64) float64 {
+	simple := 0.5 * (tempf + 61.0 + ((tempf - 68.0) * 1.2) + (humidity * 0.094))
+	if (simple+tempf)/2 < 80 {
+		return simple
+	}
+
+	hi := -42.379 + 2.04901523*tempf + 10.14333127*humidity -
+		0.22475541*tempf*humidity - 0.00683783*tempf*tempf -
+		0.05481717*humidity*humidity + 0.00122874*tempf*tempf*humidity +
+		0.00085282*tempf*humidity*humidity - 0.00000199*tempf*tempf*humidity*humidity
+
+	switch {
+	case humidity < 13 && tempf >= 80 && tempf <= 112:
+		hi -= ((13 - humidity) / 4) * math.Sqrt((17-math.Abs(tempf-95))/17)
+	case humidity > 85 && tempf >= 80 && tempf <= 87:
+		hi += ((humidity - 85) / 10) * ((87 - tempf) / 5)
+	}
+	return hi
+}
+
+// windChill computes the US National Weather Service wind chill in °F.
+// Wind chill is only defined at or below 50°F with wind of at least 3 mph, otherwise the temperature is returned.
+// See https://www.weather.gov/media/epz/wxcalc/windChill.pdf
+func windChill(tempf, windspeedmph float64) float64 {
+	if tempf > 50 || windspeedmph < 3 {
+		return tempf
+	}
+	v := math.Pow(windspeedmph, 0.16)
+	return 35.74 + 0.6215*tempf - 35.75*v + 0.4275*tempf*v
+}
+
+// apparentTemperature computes the Australian Bureau of Meteorology apparent temperature in °F.
+// See http://www.bom.gov.au/info/thermal_stress/#atapproximation
+func apparentTemperature(tempf, humidity, windspeedmph float64) float64 {
+	tempc := fahrenheitToCelsius(tempf)
+	windspeedms := windspeedmph * 0.44704
+	// Water vapour pressure in hPa
+	e := humidity / 100 * 6.105 * math.Exp(17.27*tempc/(237.7+tempc))
+	return celsiusToFahrenheit(tempc + 0.33*e - 0.70*windspeedms - 4.00)
+}
+
+// celsiusField returns the name of the Celsius equivalent of a Fahrenheit temperature field, e.g. tempc for tempf
+// and feelsLikeC for feelsLike, or false when the field isn't a temperature.
+func celsiusField(field string) (string, bool) {
+	switch {
+	case field == "feelsLike" || field == "dewPoint" || field == "feelsLikein" || field == "dewPointin":
+		return field + "C", true
+	case strings.HasPrefix(field, "temp") && strings.HasSuffix(field, "f"):
+		return strings.TrimSuffix(field, "f") + "c", true
+	default:
+		return "", false
+	}
+}
+
+// addCelsius adds the Celsius equivalent of every Fahrenheit temperature field in record, including those nested a
+// level down like indoor.tempf, alongside the original. Equivalents already converted from the unrounded value by
+// setRounded are kept.
+func (f *DataFlags) addCelsius(record map[string]any) {
+	celsius := make(map[string]any)
+	for field, value := range record {
+		if nested, ok := value.(map[string]any); ok {
+			f.addCelsius(nested)
+			continue
+		}
+		name, ok := celsiusField(field)
+		if _, converted := record[name]; !ok || converted {
+			continue
+		}
+		if tempf, ok := float64Field(record, field); ok {
+			celsius[name] = f.round(name, fahrenheitToCelsius(tempf))
+		}
+	}
+	maps.Copy(record, celsius)
+}
+
+// addLocalTimestamp adds datelocal, record's dateutc as an ISO 8601 time with offset in location, alongside dateutc.
+func addLocalTimestamp(record map[string]any, location *time.Location) {
+	if t, ok := timeField(record, "dateutc"); ok {
+		record["datelocal"] = t.In(location).Format(time.RFC3339)
+	}
+}
+
+// windUnits are the units wind speeds in mph are also converted to by --wind-units, keyed by field suffix.
+var windUnits = []struct {
+	Suffix string
+	PerMPH float64
+}{
+	{"kmh", 1.609344},
+	{"ms", 0.44704},
+	{"knots", 0.868976},
+}
+
+// addWindUnits adds the km/h, m/s and knots equivalents of every mph wind speed field in record, e.g. windspeedkmh
+// for windspeedmph, alongside the original.
+func (f *DataFlags) addWindUnits(record map[string]any) {
+	converted := make(map[string]any)
+	for field := range record {
+		base, ok := strings.CutSuffix(field, "mph")
+		if !ok || !strings.HasPrefix(field, "wind") {
+			continue
+		}
+		mph, ok := float64Field(record, field)
+		if !ok {
+			continue
+		}
+		for _, unit := range windUnits {
+			name := base + unit.Suffix
+			converted[name] = f.round(name, mph*unit.PerMPH)
+		}
+	}
+	maps.Copy(record, converted)
+}
+
+func fahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+func celsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+// degreeHours integrates how far tempf was below base, or above it when cooling, over the raw historical records,
+// weighting each reading by the time until the next. It returns nil when there are fewer than two readings.
+func degreeHours(ctx context.Context, records []map[string]any, base float64, mode string) *float64 {
+	samples := slices.SortedFunc(slices.Values(parseSamples(ctx, records, []string{"tempf"})), func(a, b historicalSample) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+	if len(samples) < 2 {
+		return nil
+	}
+
+	var total float64
+	for i, sample := range samples[:len(samples)-1] {
+		degrees := base - sample.Values["tempf"]
+		if mode == degreeModeCooling {
+			degrees = -degrees
+		}
+		hours := time.Duration(samples[i+1].Timestamp-sample.Timestamp) * time.Millisecond
+		total += max(0, degrees) * hours.Hours()
+	}
+	return &total
+}
+
+// rollingExtremes are the highest and lowest tempf readings and when each occurred, in milliseconds.
+type rollingExtremes struct {
+	High, Low     float64
+	HighAt, LowAt int64
+	// Covered is whether the records span the whole window.
+	Covered bool
+}
+
+// rollingHighLow returns the highest and lowest tempf over the window ending at the most recent raw historical record.
+// It returns false when there are no readings.
+func rollingHighLow(ctx context.Context, records []map[string]any, window time.Duration) (rollingExtremes, bool) {
+	samples := parseSamples(ctx, records, []string{"tempf"})
+	if len(samples) == 0 {
+		return rollingExtremes{}, false
+	}
+
+	first, last := samples[0].Timestamp, samples[0].Timestamp
+	for _, sample := range samples {
+		first = min(first, sample.Timestamp)
+		last = max(last, sample.Timestamp)
+	}
+	startMs := last - window.Milliseconds()
+
+	// Allow for a station's 5 minute reporting interval so the default 288 records count as covering 24 hours
+	covered := first-startMs <= (5 * time.Minute).Milliseconds()
+	extremes := rollingExtremes{High: math.Inf(-1), Low: math.Inf(1), Covered: covered}
+	for _, sample := range samples {
+		if sample.Timestamp < startMs {
+			continue
+		}
+		if tempf := sample.Values["tempf"]; tempf > extremes.High {
+			extremes.High, extremes.HighAt = tempf, sample.Timestamp
+		}
+		if tempf := sample.Values["tempf"]; tempf < extremes.Low {
+			extremes.Low, extremes.LowAt = tempf, sample.Timestamp
+		}
+	}
+	return extremes, true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBatteryLow(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]any
+		want   *bool
+	}{
+		{"no batteries", map[string]any{"tempf": 70.0}, nil},
+		{"outdoor ok", map[string]any{"battout": 1.0}, ptr(false)},
+		{"outdoor low", map[string]any{"battout": 0.0}, ptr(true)},
+		{"lightning ok", map[string]any{"batt_lightning": 0.0}, ptr(false)},
+		{"lightning low", map[string]any{"batt_lightning": 1.0}, ptr(true)},
+		{"leak ok", map[string]any{"batleak1": 0.0}, ptr(false)},
+		{"leak low", map[string]any{"batleak3": 1.0}, ptr(true)},
+		{"one low of many", map[string]any{"battout": 1.0, "batt1": 1.0, "batt_lightning": 1.0}, ptr(true)},
+		{"unknown batt prefixed field ignored", map[string]any{"battery_voltage": 0.0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := batteryLow(tt.fields)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("batteryLow(%v) = %v, want %v", tt.fields, deref(got), deref(tt.want))
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func deref[T any](p *T) any {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+func TestCelsiusConversion(t *testing.T) {
+	tests := []struct {
+		field     string
+		tempf     float64
+		wantField string
+		want      float64
+	}{
+		{"tempf", 72.1, "tempc", 22.3},
+		// Converted from the unrounded value, 72.2°F would be 22.3°C
+		{"tempf", 72.24, "tempc", 22.4},
+		{"temp1f", 32, "temp1c", 0},
+		{"feelsLike", -40, "feelsLikeC", -40},
+		{"dewPointin", 50, "dewPointinC", 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			name, ok := celsiusField(tt.field)
+			if !ok || name != tt.wantField {
+				t.Fatalf("celsiusField(%q) = %q, %v, want %q, true", tt.field, name, ok, tt.wantField)
+			}
+
+			opts := testDataFlags()
+			opts.FahrenheitAndCelsius = true
+			record := map[string]any{}
+			opts.setRounded(record, tt.field, tt.tempf)
+			if got := record[tt.wantField]; got != tt.want {
+				t.Errorf("%s = %v, want %v", tt.wantField, got, tt.want)
+			}
+		})
+	}
+
+	for _, field := range []string{"humidity", "windspeedmph", "temperature"} {
+		if name, ok := celsiusField(field); ok {
+			t.Errorf("celsiusField(%q) = %q, want no Celsius equivalent", field, name)
+		}
+	}
+}
+
+func TestConditionsSummaryFromRawData(t *testing.T) {
+	tests := []struct {
+		name     string
+		latest   map[string]any
+		lastData map[string]any
+		want     string
+	}{
+		{
+			name:     "wind and rain only in raw data",
+			latest:   map[string]any{"tempf": 72.1},
+			lastData: map[string]any{"tempf": 70.0, "windspeedmph": 5.0, "hourlyrainin": 0.0},
+			want:     "Dry, 72°F, light breeze",
+		},
+		{
+			name:     "sent values take precedence",
+			latest:   map[string]any{"tempf": 72.1, "windspeedmph": 20.0},
+			lastData: map[string]any{"windspeedmph": 5.0, "hourlyrainin": 0.5},
+			want:     "Heavy rain, 72°F, windy",
+		},
+		{
+			name:   "latest only",
+			latest: map[string]any{"tempf": 72.1},
+			want:   "72°F",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testDataFlags()
+			opts.ConditionsSummary = true
+			mv := &MergeVariables{Latest: tt.latest}
+			derive(context.Background(), mv, tt.lastData, opts)
+			if mv.Conditions != tt.want {
+				t.Errorf("conditions = %q, want %q", mv.Conditions, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/lrosenman/ambient"
+)
+
+func (c *DevicesCmd) Run(ctx *kong.Context) error {
+	runCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	key := c.Key()
+	results, err := callAmbient(runCtx, func() (ambient.APIDeviceResponse, error) { return ambient.Device(key) })
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(results.HTTPResponseCode, results.JSONResponse); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(ctx.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MAC\tNAME\tLOCATION\tLATEST")
+	for _, r := range results.DeviceRecord {
+		latest := "-"
+		if t, ok := timeField(r.LastDataFields, "dateutc"); ok {
+			latest = t.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Macaddress, r.Info.Name, r.Info.Location, latest)
+	}
+	return tw.Flush()
+}
+
+func (c *ListFieldsCmd) Run(ctx *kong.Context) error {
+	runCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := c.ResolveDevice(runCtx); err != nil {
+		return err
+	}
+
+	key := c.Key()
+	results, err := callAmbient(runCtx, func() (ambient.APIDeviceResponse, error) { return ambient.Device(key) })
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(results.HTTPResponseCode, results.JSONResponse); err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(results.DeviceRecord, func(r ambient.DeviceRecord) bool { return r.Macaddress == c.Device })
+	if index < 0 {
+		return fmt.Errorf("no device data found for device MAC: %s", c.Device)
+	}
+	// Decode precisely so values are listed exactly as the station reported them
+	lastData := preciseLastData(runCtx, results.JSONResponse, index, results.DeviceRecord[index].LastDataFields)
+
+	tw := tabwriter.NewWriter(ctx.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tVALUE\tTYPE")
+	for _, field := range slices.Sorted(maps.Keys(lastData)) {
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", field, lastData[field], fieldType(lastData[field]))
+	}
+	return tw.Flush()
+}
+
+// fieldType returns the JSON type of a decoded field value.
+func fieldType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// DeviceMacByName looks up the MAC address of the device whose name, as configured in the Ambient Weather app,
+// matches name case-insensitively. Exactly one device must match.
+func DeviceMacByName(ctx context.Context, key ambient.Key, name string) (string, error) {
+	slog.InfoContext(ctx, "looking up device by name", slog.String("name", name))
+	results, err := callAmbient(ctx, func() (ambient.APIDeviceResponse, error) { return ambient.Device(key) })
+	if err != nil {
+		return "", err
+	}
+	if err := checkResponse(results.HTTPResponseCode, results.JSONResponse); err != nil {
+		return "", err
+	}
+
+	var matches []string
+	for _, r := range results.DeviceRecord {
+		if strings.EqualFold(strings.TrimSpace(r.Info.Name), strings.TrimSpace(name)) {
+			matches = append(matches, r.Macaddress)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no device found with name: %q", name)
+	case 1:
+		slog.InfoContext(ctx, "found device by name", slog.String("name", name), slog.String("mac", matches[0]))
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%d devices found with name: %q, MACs: %s", len(matches), name, strings.Join(matches, ", "))
+	}
+}
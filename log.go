@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+)
+
+// logAttrsKey is the context key for attributes added to every log record made with that context.
+type logAttrsKey struct{}
+
+// contextHandler adds the attributes carried by a context, e.g. an update cycle ID, to every log record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// withLogAttrs returns a context whose log records include attrs along with any it already carries.
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	return context.WithValue(ctx, logAttrsKey{}, slices.Concat(existing, attrs))
+}
+
+// withCycleID returns a context whose log records include a new short ID so that every line logged during one
+// update cycle can be correlated.
+func withCycleID(ctx context.Context) context.Context {
+	return withLogAttrs(ctx, slog.String("cycle", fmt.Sprintf("%08x", rand.Uint32())))
+}
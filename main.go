@@ -2,6 +2,7 @@ package main
 
 import (
 	"log/slog"
+	"net"
 	"os"
 
 	"github.com/alecthomas/kong"
@@ -20,13 +21,29 @@ func main() {
 	logLevel := slog.LevelInfo
 	if cli.Debug {
 		logLevel = slog.LevelDebug
+	} else if cli.Quiet {
+		logLevel = slog.LevelWarn
 	}
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	logger := slog.New(contextHandler{slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		AddSource: true,
 		Level:     logLevel,
-	}))
+	})})
 	slog.SetDefault(logger)
 
+	if cli.LocalAddr != "" {
+		bindLocalAddr(net.ParseIP(cli.LocalAddr))
+	}
+
+	ambientTimeout = cli.AmbientTimeout
+
+	if cli.StatsdAddr != "" {
+		var err error
+		if metrics, err = newStatsd(cli.StatsdAddr); err != nil {
+			slog.Error("error", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+	}
+
 	if err := ctx.Run(&cli.Globals); err != nil {
 		slog.Error("error", slog.String("err", err.Error()))
 		os.Exit(1)
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Payload shapes selectable with --payload-shape.
+const (
+	// payloadShapeWrapped nests the merge variables under "merge_variables" as TRMNL private plugin webhooks expect.
+	payloadShapeWrapped = "wrapped"
+	// payloadShapeBare sends the merge variables themselves, e.g. for polling plugins which use the JSON as is.
+	payloadShapeBare = "bare"
+)
+
+// Payload schemas selectable with --schema.
+const (
+	// payloadSchemaMergeVariables sends the merge variables as is.
+	payloadSchemaMergeVariables = "merge-variables"
+	// payloadSchemaTRMNLFields sends the latest reading as a flat list of label and value fields.
+	payloadSchemaTRMNLFields = "trmnl-fields"
+)
+
+// payloadFormat is how data is encoded for TRMNL.
+type payloadFormat struct {
+	Shape  string
+	Schema string
+}
+
+// encodePayload writes data to w as JSON in the given payload format.
+func encodePayload(w io.Writer, data *WebhookData, format payloadFormat) error {
+	if format.Schema == payloadSchemaTRMNLFields {
+		return encodeFields(w, data, format.Shape)
+	}
+
+	var payload any = data
+	if format.Shape == payloadShapeBare {
+		payload = data.MergeVariables
+	}
+	return json.NewEncoder(w).Encode(payload)
+}
+
+// field is a labelled value in the trmnl-fields schema.
+type field struct {
+	Label string `json:"label"`
+	Value any    `json:"value"`
+}
+
+// fieldLabels are the labels of well known latest fields in the order they're listed in the trmnl-fields schema.
+// Any other fields follow, labelled by name in alphabetical order.
+var fieldLabels = []struct{ Field, Label string }{
+	{"tempf", "Temperature"},
+	{"feelsLike", "Feels Like"},
+	{"humidity", "Humidity"},
+	{"dailyrainin", "Rain Today"},
+	{"dateutc", "Updated"},
+}
+
+// encodeFields writes data's latest reading to w as JSON in the trmnl-fields schema, a flat list of label and value
+// fields under "fields", nested under "merge_variables" in the wrapped shape. Nested fields, e.g. indoor, are skipped.
+func encodeFields(w io.Writer, data *WebhookData, shape string) error {
+	latest := data.MergeVariables.Latest
+	fields := make([]field, 0, len(latest))
+	labelled := make(map[string]bool, len(fieldLabels))
+	for _, l := range fieldLabels {
+		labelled[l.Field] = true
+		if value, ok := latest[l.Field]; ok {
+			fields = append(fields, field{Label: l.Label, Value: value})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(latest)) {
+		if _, nested := latest[name].(map[string]any); labelled[name] || nested {
+			continue
+		}
+		fields = append(fields, field{Label: name, Value: latest[name]})
+	}
+
+	var payload any = map[string]any{"fields": fields}
+	if shape != payloadShapeBare {
+		payload = map[string]any{"merge_variables": payload}
+	}
+	return json.NewEncoder(w).Encode(payload)
+}
+
+// writePayloadFile atomically replaces the file at path with data encoded in the given payload format, so a reader
+// never sees a partially written payload. It returns the size of the written payload in bytes.
+func writePayloadFile(path string, data *WebhookData, format payloadFormat) (int, error) {
+	var buffer bytes.Buffer
+	if err := encodePayload(&buffer, data, format); err != nil {
+		return 0, fmt.Errorf("error marshaling payload: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("error creating payload file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+
+	// Temporary files are only readable by their owner but the payload is meant for another process to pick up
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("error writing payload file: %w", err)
+	}
+	if _, err := tmp.Write(buffer.Bytes()); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("error writing payload file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("error writing payload file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, fmt.Errorf("error replacing payload file: %w", err)
+	}
+	return buffer.Len(), nil
+}
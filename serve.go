@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/lrosenman/ambient"
+)
+
+// dataCache holds the most recently fetched webhook data so that frequent polling doesn't exceed the
+// Ambient Weather API rate limits.
+type dataCache struct {
+	mu        sync.Mutex
+	data      *WebhookData
+	fetchedAt time.Time
+	// inflight is the fetch in progress, if any, which concurrent requests wait on rather than fetching again
+	inflight *fetchCall
+}
+
+// fetchCall is a fetch shared by every request that needs fresh data while it's in progress.
+type fetchCall struct {
+	done chan struct{}
+	data *WebhookData
+	err  error
+}
+
+// get returns the cached data if it is younger than ttl, otherwise it fetches fresh data. Concurrent requests for
+// fresh data share a single fetch. If fetching fails, previously cached data is returned instead so polling clients
+// still receive something, unless it's older than maxAge when that's positive.
+func (c *dataCache) get(ctx context.Context, ttl, maxAge time.Duration,
+	fetch func(context.Context) (*WebhookData, error)) (*WebhookData, error) {
+	c.mu.Lock()
+	data, fetchedAt := c.data, c.fetchedAt
+
+	if data != nil && time.Since(fetchedAt) < ttl {
+		c.mu.Unlock()
+		slog.DebugContext(ctx, "serving cached data", slog.Duration("age", time.Since(fetchedAt)))
+		return data, nil
+	}
+
+	call := c.inflight
+	if call != nil {
+		c.mu.Unlock()
+		slog.DebugContext(ctx, "waiting for in flight fetch")
+		<-call.done
+	} else {
+		call = &fetchCall{done: make(chan struct{})}
+		c.inflight = call
+		c.mu.Unlock()
+		c.fetch(ctx, call, fetch)
+	}
+
+	if call.err != nil {
+		if data == nil {
+			return nil, call.err
+		}
+		age := cachedAge(data, fetchedAt)
+		if maxAge > 0 && age > maxAge {
+			slog.WarnContext(ctx, "failed to fetch fresh data and cached data is too old to serve",
+				slog.Duration("age", age),
+				slog.Duration("cache_max_age", maxAge))
+			return nil, call.err
+		}
+		slog.WarnContext(ctx, "failed to fetch fresh data, serving cached data",
+			slog.String("err", call.err.Error()),
+			slog.Duration("age", age))
+		return data, nil
+	}
+	return call.data, nil
+}
+
+// fetch runs call's fetch, caching its data if it succeeds. The call is finished even if fetch panics so that
+// waiting and later requests aren't blocked on it forever.
+func (c *dataCache) fetch(ctx context.Context, call *fetchCall, fetch func(context.Context) (*WebhookData, error)) {
+	call.err = errors.New("fetch did not complete")
+	defer func() {
+		c.mu.Lock()
+		if call.err == nil {
+			c.data = call.data
+			c.fetchedAt = time.Now()
+		}
+		c.inflight = nil
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.data, call.err = fetch(ctx)
+}
+
+func (c *ServeCmd) Run(ctx *kong.Context) error {
+	runCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := c.ResolveDevice(runCtx); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /webhook-data", c.handleWebhookData(c.Key(), &dataCache{}))
+
+	server := &http.Server{
+		Addr:              c.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	slog.Info("serving webhook data", slog.String("listen", c.Listen), slog.Duration("cache ttl", c.CacheTTL))
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-runCtx.Done():
+		slog.Info("received signal, shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+}
+
+// cachedAge returns how old cached data is, from its latest reading's timestamp when it has one since the reading
+// may already have been old when it was fetched, otherwise from when it was fetched.
+func cachedAge(data *WebhookData, fetchedAt time.Time) time.Duration {
+	if dateutc, ok := timeField(data.MergeVariables.Latest, "dateutc"); ok && dateutc.Before(fetchedAt) {
+		return time.Since(dateutc)
+	}
+	return time.Since(fetchedAt)
+}
+
+// handleWebhookData responds with the WebhookData JSON that would otherwise be sent to the TRMNL webhook URL.
+func (c *ServeCmd) handleWebhookData(key ambient.Key, cache *dataCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := withCycleID(r.Context())
+		data, err := cache.get(ctx, c.CacheTTL, c.CacheMaxAge, func(ctx context.Context) (*WebhookData, error) {
+			// The fetched data is cached for other requests so don't let this one's cancellation interrupt it
+			return Data(context.WithoutCancel(ctx), key, c.Device, &c.DataFlags)
+		})
+		if err != nil {
+			status := http.StatusBadGateway
+			var maintenanceErr *MaintenanceError
+			if isRateLimited(err) || errors.As(err, &maintenanceErr) {
+				status = http.StatusServiceUnavailable
+			}
+			slog.ErrorContext(ctx, "failed to get webhook data", slog.String("err", err.Error()), slog.Int("status", status))
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := encodePayload(w, data, c.PayloadFormat()); err != nil {
+			slog.ErrorContext(ctx, "failed to write webhook data", slog.String("err", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDataCacheSharesFetch(t *testing.T) {
+	const requests = 10
+	cache := &dataCache{}
+	want := &WebhookData{MergeStrategy: deepMergeStrategy}
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func(context.Context) (*WebhookData, error) {
+		fetches.Add(1)
+		<-release
+		return want, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*WebhookData, requests)
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := cache.get(context.Background(), time.Minute, 0, fetch)
+			if err != nil {
+				t.Errorf("get() error = %v", err)
+			}
+			results[i] = data
+		}()
+	}
+
+	// Let every request reach the cache before the fetch finishes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("fetches = %d, want 1", got)
+	}
+	for i, data := range results {
+		if data != want {
+			t.Errorf("request %d got %v, want the fetched data", i, data)
+		}
+	}
+}
+
+func TestDataCacheRecoversFromPanickingFetch(t *testing.T) {
+	cache := &dataCache{}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the fetch's panic to propagate")
+			}
+		}()
+		cache.get(context.Background(), time.Minute, 0, func(context.Context) (*WebhookData, error) {
+			panic("boom")
+		})
+	}()
+
+	want := errors.New("unavailable")
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.get(context.Background(), time.Minute, 0, func(context.Context) (*WebhookData, error) {
+			return nil, want
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, want) {
+			t.Errorf("get() error = %v, want %v", err, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("get() blocked on the panicked fetch")
+	}
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
@@ -13,47 +14,243 @@ import (
 )
 
 func (c *ServerCmd) Run(ctx *kong.Context) error {
+	// A shutdown signal cancels in progress API calls, webhook requests and waits
+	runCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := c.ResolveDevice(runCtx); err != nil {
+		return err
+	}
+
+	ambientKey := c.Key()
+	webhook := c.Webhook()
+	webhook.DeltaOnly = c.DeltaOnly
+	webhook.Device = c.Device
+	if c.RetryRefetch {
+		webhook.Refetch = func(ctx context.Context) (*WebhookData, error) {
+			return Data(ctx, ambientKey, c.Device, &c.DataFlags)
+		}
+	}
+
+	if c.VerifyWebhook {
+		if err := webhook.Ping(withCycleID(runCtx)); err != nil {
+			return err
+		}
+	}
+
+	if c.Interval <= 0 {
+		// Run a single update
+		if c.WarmupDelay > 0 {
+			slog.Info("waiting before the first update", slog.Duration("warmup_delay", c.WarmupDelay))
+			if sleep(runCtx, c.WarmupDelay) != nil {
+				return nil
+			}
+		}
+		return Update(runCtx, ambientKey, c.Device, &c.DataFlags, webhook)
+	}
+
+	if c.AutoInterval {
+		c.autoInterval(runCtx, ambientKey)
+		if runCtx.Err() != nil {
+			return nil
+		}
+	}
+
 	ticker := time.NewTicker(c.Interval)
 	defer ticker.Stop()
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	defer signal.Stop(sigCh)
+	// SIGUSR1 logs the update status on demand, for hosts where nothing else exposes it
+	statusCh := make(chan os.Signal, 1)
+	signal.Notify(statusCh, syscall.SIGUSR1)
+	defer signal.Stop(statusCh)
+	var status updateStatus
 
-	ambientKey := ambient.NewKey(c.ApplicationKey, c.APIKey)
+	var alerts *alerter
+	if c.AlertWebhook != nil {
+		alerts = &alerter{URL: c.AlertWebhook, After: c.AlertAfter, Throttle: c.AlertThrottle}
+	}
 
-	slog.Info("running server", slog.Duration("update interval", c.Interval))
+	// retry fires when a rate limited update should be retried sooner than the next tick
+	var retry <-chan time.Time
 
-	if err := Update(ambientKey, c.Device, c.ResultsLimit, c.WebhookUrl); err != nil {
-		if isRateLimited(err) {
-			slog.Warn("rate limited on initial request, applying backoff", slog.Duration("backoff", c.Interval))
+	// interval doubles after each consecutive failure, up to MaxBackoff, and resets on success
+	interval := c.Interval
+
+	// update runs an update, scheduling a retry when the API said when its rate limit resets and otherwise
+	// adjusting the ticker interval to back off on failure or recover on success
+	update := func(msg string, allowRetry bool) {
+		err := Update(runCtx, ambientKey, c.Device, &c.DataFlags, webhook)
+		if runCtx.Err() != nil {
+			// Shutting down, the update was cancelled rather than failed
+			return
+		}
+		status.record(err, webhook.lastSent)
+
+		// Maintenance is expected and resolves itself so wait it out quietly rather than alerting
+		var maintenanceErr *MaintenanceError
+		if errors.As(err, &maintenanceErr) {
+			interval = max(interval, c.MaintenanceBackoff)
+			ticker.Reset(interval)
+			slog.Warn("upstream maintenance, backing off", slog.Duration("backoff", interval))
+			return
+		}
+		alerts.record(err)
+
+		if err == nil {
+			if interval != c.Interval {
+				interval = c.Interval
+				ticker.Reset(interval)
+				slog.Info("recovered, resetting update interval", slog.Duration("interval", interval))
+			}
+			return
+		}
+
+		var rateLimitErr *RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			if allowRetry && rateLimitErr.RetryAfter > 0 {
+				retry = time.After(rateLimitErr.RetryAfter)
+				slog.Warn("rate limited, retrying after rate limit resets", slog.Duration("retry_after", rateLimitErr.RetryAfter))
+				return
+			}
 		} else {
-			slog.Error("failed on initial update", slog.String("err", err.Error()))
+			slog.Error(msg, slog.String("err", err.Error()))
 		}
-		// Don't return error, continue running
+
+		// Reset the ticker to implement backoff
+		interval = min(interval*2, max(c.MaxBackoff, c.Interval))
+		ticker.Reset(interval)
+		slog.Warn("applying backoff", slog.Bool("rate_limited", rateLimitErr != nil), slog.Duration("backoff", interval))
 	}
 
+	slog.Info("running server", slog.Duration("update interval", c.Interval))
+
+	if c.WarmupDelay > 0 {
+		// Give networking a chance to settle, e.g. in a just started container
+		slog.Info("waiting before the first update", slog.Duration("warmup_delay", c.WarmupDelay))
+		if sleep(runCtx, c.WarmupDelay) != nil {
+			slog.Info("received signal, shutting down")
+			return nil
+		}
+		ticker.Reset(c.Interval)
+	}
+
+	// Don't return error, continue running
+	update("failed on initial update", true)
+
 	for {
 		select {
 		case <-ticker.C:
-			err := Update(ambientKey, c.Device, c.ResultsLimit, c.WebhookUrl)
-			if err != nil {
-				if isRateLimited(err) {
-					// Reset the ticker to implement backoff
-					ticker.Reset(c.Interval)
-					slog.Warn("rate limited, applying backoff", slog.Duration("backoff", c.Interval))
-				} else {
-					slog.Error("failed to update", slog.String("err", err.Error()))
-				}
-			}
-		case sig := <-sigCh:
-			slog.Info("received signal, shutting down", slog.String("signal", sig.String()))
+			retry = nil
+			update("failed to update", true)
+		case <-retry:
+			retry = nil
+			// Only retry once per tick so a persistent rate limit doesn't hammer the API
+			update("failed to update on retry", false)
+		case <-statusCh:
+			status.log(interval)
+		case <-runCtx.Done():
+			slog.Info("received signal, shutting down")
 			return nil
 		}
 	}
 }
 
+// minAutoInterval is the shortest update interval --auto-interval will choose, keeping well clear of rate limits.
+const minAutoInterval = time.Minute
+
+// autoInterval sets Interval to the station's median reporting interval, found from historical record timestamps,
+// keeping the configured interval when it can't be found.
+func (c *ServerCmd) autoInterval(ctx context.Context, key ambient.Key) {
+	ctx = withCycleID(ctx)
+	records, err := Historical(ctx, key, c.Device, &c.DataFlags)
+	// Give the rate limit a chance to reset before the first update
+	if sleep(ctx, ambientRateLimitWindow) != nil {
+		return
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "could not detect reporting interval, keeping update interval",
+			slog.String("err", err.Error()), slog.Duration("interval", c.Interval))
+		return
+	}
+
+	gap, ok := medianReportingGap(records)
+	if !ok {
+		slog.WarnContext(ctx, "not enough historical data to detect reporting interval, keeping update interval",
+			slog.Duration("interval", c.Interval))
+		return
+	}
+	c.Interval = max(gap, minAutoInterval)
+	slog.InfoContext(ctx, "detected reporting interval",
+		slog.Duration("reporting_interval", gap),
+		slog.Duration("interval", c.Interval))
+}
+
+// updateStatus tracks the outcome of the server's updates.
+type updateStatus struct {
+	successes, failures int
+	lastSuccess         time.Time
+	lastFailure         time.Time
+	lastErr             error
+	// rateLimited counts the failures which were rate limited by the Ambient Weather API, see lastRateLimited
+	rateLimited     int
+	lastRateLimited time.Time
+	// lastSent is the data the last successful update sent, nil until one has
+	lastSent *WebhookData
+}
+
+// record records the outcome of an update along with the data most recently sent.
+func (s *updateStatus) record(err error, sent *WebhookData) {
+	if err != nil {
+		s.failures++
+		s.lastFailure = time.Now()
+		s.lastErr = err
+		if isRateLimited(err) {
+			s.rateLimited++
+			s.lastRateLimited = s.lastFailure
+			metrics.count("ambient.rate_limited")
+		}
+		return
+	}
+	s.successes++
+	s.lastSuccess = time.Now()
+	s.lastSent = sent
+}
+
+// log logs the status along with the current update interval. It's logged as a warning so an operator asking for it
+// sees it even with --quiet.
+func (s *updateStatus) log(interval time.Duration) {
+	attrs := []any{
+		slog.Int("successes", s.successes),
+		slog.Int("failures", s.failures),
+		slog.Int("rate_limited", s.rateLimited),
+		slog.Duration("interval", interval),
+	}
+	if !s.lastSuccess.IsZero() {
+		attrs = append(attrs, slog.Time("last_success", s.lastSuccess))
+	}
+	if !s.lastRateLimited.IsZero() {
+		attrs = append(attrs, slog.Time("last_rate_limited", s.lastRateLimited))
+	}
+	if s.lastErr != nil {
+		attrs = append(attrs, slog.Time("last_failure", s.lastFailure), slog.String("last_err", s.lastErr.Error()))
+	}
+	if s.lastSent != nil {
+		// Summarize rather than dump the payload, which may hold hundreds of historical records
+		latest := s.lastSent.MergeVariables.Latest
+		summary := []any{
+			slog.Any("tempf", latest["tempf"]),
+			slog.Int("historical", len(s.lastSent.MergeVariables.Historical)),
+		}
+		if dateutc, ok := timeField(latest, "dateutc"); ok {
+			summary = append(summary, slog.Time("dateutc", dateutc))
+		}
+		attrs = append(attrs, slog.Group("last_sent", summary...))
+	}
+	slog.Warn("status", attrs...)
+}
+
 // isRateLimited checks if the error is a 429 Too Many Requests error
 func isRateLimited(err error) bool {
-	return err != nil && strings.Contains(err.Error(), "429")
+	var rateLimitErr *RateLimitError
+	return errors.As(err, &rateLimitErr)
 }
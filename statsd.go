@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// statsdPrefix namespaces every metric sent to StatsD.
+const statsdPrefix = "trmnl_wthr_svr."
+
+// metrics receives update, API and webhook metrics when --statsd-addr is set and is otherwise nil, discarding them.
+var metrics *statsd
+
+// statsd sends metrics to a StatsD, or DogStatsD, server over UDP. A nil statsd discards metrics.
+type statsd struct {
+	conn net.Conn
+}
+
+// newStatsd returns a statsd sending metrics to the UDP address addr, e.g. localhost:8125.
+func newStatsd(addr string) (*statsd, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to statsd %s: %w", addr, err)
+	}
+	return &statsd{conn: conn}, nil
+}
+
+// count increments the named counter.
+func (s *statsd) count(name string) {
+	s.send(name, "1|c")
+}
+
+// timing records a duration for the named timer in milliseconds.
+func (s *statsd) timing(name string, d time.Duration) {
+	s.send(name, fmt.Sprintf("%d|ms", d.Milliseconds()))
+}
+
+// gauge sets the named gauge.
+func (s *statsd) gauge(name string, value int) {
+	s.send(name, fmt.Sprintf("%d|g", value))
+}
+
+func (s *statsd) send(name, value string) {
+	if s == nil {
+		return
+	}
+	// UDP writes only fail locally and metrics are best effort so don't let them get in the way of updates
+	if _, err := fmt.Fprintf(s.conn, "%s%s:%s", statsdPrefix, name, value); err != nil {
+		slog.Debug("could not send metric", slog.String("metric", name), slog.String("err", err.Error()))
+	}
+}
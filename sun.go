@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// julianDayUnixEpoch is the Julian day of the Unix epoch.
+const julianDayUnixEpoch = 2440587.5
+
+// sunTimes computes the sunrise and sunset on the day of t, in t's location, for the given coordinates using the
+// sunrise equation. See https://en.wikipedia.org/wiki/Sunrise_equation
+// The boolean result is false when the sun doesn't rise or set that day, e.g. during polar night or midnight sun, in
+// which case daytime reports whether the sun is up all day.
+func sunTimes(t time.Time, latitude, longitude float64) (sunrise, sunset time.Time, daytime, ok bool) {
+	// The Julian day at the start of the local date, the sunrise equation works out the solar noon from there
+	year, month, day := t.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	julianDay := float64(midnight.Unix())/86400 + julianDayUnixEpoch
+
+	n := math.Ceil(julianDay - 2451545.0 + 0.0008)
+	meanSolarTime := n - longitude/360
+	meanAnomaly := math.Mod(357.5291+0.98560028*meanSolarTime, 360)
+	center := 1.9148*sin(meanAnomaly) + 0.0200*sin(2*meanAnomaly) + 0.0003*sin(3*meanAnomaly)
+	eclipticLongitude := math.Mod(meanAnomaly+center+180+102.9372, 360)
+	transit := 2451545.0 + meanSolarTime + 0.0053*sin(meanAnomaly) - 0.0069*sin(2*eclipticLongitude)
+	declination := math.Asin(sin(eclipticLongitude) * sin(23.4397))
+
+	// -0.833° accounts for atmospheric refraction and the size of the solar disc
+	cosHourAngle := (sin(-0.833) - sin(latitude)*math.Sin(declination)) / (cos(latitude) * math.Cos(declination))
+	if cosHourAngle > 1 || cosHourAngle < -1 {
+		return time.Time{}, time.Time{}, cosHourAngle < -1, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	sunrise = julianDayTime(transit - hourAngle/360).In(t.Location())
+	sunset = julianDayTime(transit + hourAngle/360).In(t.Location())
+	return sunrise, sunset, !t.Before(sunrise) && t.Before(sunset), true
+}
+
+// julianDayTime converts a Julian day to a time.
+func julianDayTime(julianDay float64) time.Time {
+	seconds := (julianDay - julianDayUnixEpoch) * 86400
+	return time.Unix(0, int64(seconds*float64(time.Second))).Truncate(time.Second)
+}
+
+// sin returns the sine of degrees.
+func sin(degrees float64) float64 {
+	return math.Sin(degrees * math.Pi / 180)
+}
+
+// cos returns the cosine of degrees.
+func cos(degrees float64) float64 {
+	return math.Cos(degrees * math.Pi / 180)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/alecthomas/kong"
+)
+
+// referenceTemplate is TRMNL private plugin markup consuming exactly the merge variables this server sends. Keep it
+// in step with MergeVariables so it remains a living reference.
+//
+//go:embed templates/full.liquid
+var referenceTemplate string
+
+func (c *TemplateCmd) Run(ctx *kong.Context) error {
+	_, err := fmt.Fprint(ctx.Stdout, referenceTemplate)
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// bindLocalAddr makes outbound requests, both to Ambient Weather and the webhook, originate from the given local IP
+// address. The Ambient Weather client uses the default HTTP client so its transport is the one configured.
+func bindLocalAddr(ip net.IP) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: &net.TCPAddr{IP: ip},
+	}
+	http.DefaultTransport.(*http.Transport).DialContext = dialer.DialContext
+}
+
+// loadCertPool returns a certificate pool of the PEM encoded certificates in the file at path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in CA file %s", path)
+	}
+	return pool, nil
+}
+
+// clientWithRootCAs returns an HTTP client like the default one that trusts only the certificate authorities in
+// pool, e.g. a private CA the system doesn't trust.
+func clientWithRootCAs(pool *x509.CertPool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}
+}
+
+// blockPrivateAddrs returns an HTTP client like client which refuses to send requests to private, loopback or
+// link-local addresses, e.g. when the webhook URL is user supplied in a shared environment. The address is checked
+// once connected, before anything is sent, so a host name can't be rebound to a private address after it's checked.
+func blockPrivateAddrs(client *http.Client) *http.Client {
+	base := http.DefaultTransport
+	if client.Transport != nil {
+		base = client.Transport
+	}
+	transport := base.(*http.Transport).Clone()
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && isPrivateIP(tcpAddr.IP) {
+			conn.Close()
+			slog.WarnContext(ctx, "blocked request to private address", slog.String("addr", addr), slog.String("ip", tcpAddr.IP.String()))
+			return nil, fmt.Errorf("refusing to connect to %s, it resolves to private address %s", addr, tcpAddr.IP)
+		}
+		return conn, nil
+	}
+	return &http.Client{Transport: transport, Timeout: client.Timeout}
+}
+
+// isPrivateIP reports whether ip is in a private, loopback, link-local or unspecified range.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// unixSocketScheme is the scheme of webhook URLs delivered over a Unix domain socket, see parseUnixSocketURL.
+const unixSocketScheme = "unix"
+
+// parseUnixSocketURL splits a Unix domain socket webhook URL like unix:///path/to/socket:/webhook into the socket's
+// path and the HTTP URL requested over it, keeping any query.
+func parseUnixSocketURL(u *url.URL) (string, *url.URL, error) {
+	socket, path, ok := strings.Cut(u.Path, ":")
+	if !ok || socket == "" || !strings.HasPrefix(path, "/") {
+		return "", nil, fmt.Errorf("invalid Unix socket webhook URL %q, expected unix:///path/to/socket:/path", u)
+	}
+	return socket, &url.URL{Scheme: "http", Host: "localhost", Path: path, RawQuery: u.RawQuery}, nil
+}
+
+// unixSocketClient returns an HTTP client like client which connects to the Unix domain socket at socket whatever
+// the requested host.
+func unixSocketClient(client *http.Client, socket string) *http.Client {
+	base := http.DefaultTransport
+	if client.Transport != nil {
+		base = client.Transport
+	}
+	transport := base.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+	return &http.Client{Transport: transport, Timeout: client.Timeout}
+}
@@ -2,266 +2,1322 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"maps"
 	"math"
 	"net/http"
-	"net/url"
-	"sort"
-	"strconv"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/lrosenman/ambient"
 )
 
+// ambientRateLimitWindow is the documented window in which Ambient Weather API requests are rate limited.
+// "API requests are capped at 1 request/second for each user's apiKey and 3 requests/second per applicationKey."
+// -- https://ambientweather.docs.apiary.io/#introduction/rate-limiting
+const ambientRateLimitWindow = time.Second
+
+// ambientTimeout is how long an Ambient Weather API call may take, set with --ambient-timeout.
+var ambientTimeout = 30 * time.Second
+
+// callAmbient calls the Ambient Weather API with call, giving up after ambientTimeout or when ctx is cancelled. The
+// ambient library uses the default HTTP client without a context so a call can't be cancelled, instead it's
+// abandoned to finish in the background so that a hung request doesn't stall updates or shutdown.
+func callAmbient[T any](ctx context.Context, call func() (T, error)) (T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		value, err := call()
+		done <- result{value, err}
+	}()
+
+	select {
+	case r := <-done:
+		metrics.timing("ambient.latency", time.Since(start))
+		return r.value, r.err
+	case <-time.After(ambientTimeout):
+		metrics.count("ambient.timeout")
+		var zero T
+		return zero, fmt.Errorf("ambient weather API request timed out after %s", ambientTimeout)
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// sleep waits for d, returning the context's error early if it's cancelled first, e.g. on shutdown.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RateLimitError is returned when the Ambient Weather API responds with 429 Too Many Requests.
+type RateLimitError struct {
+	// RetryAfter is how long to wait before the rate limit resets, zero when unknown.
+	RetryAfter time.Duration
+	Body       []byte
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited with response code: %d, retry after: %s, json: %s",
+		http.StatusTooManyRequests, e.RetryAfter, e.Body)
+}
+
+// MaintenanceError is returned when the Ambient Weather API responds with 503 Service Unavailable, which it does
+// during its periodic maintenance.
+type MaintenanceError struct {
+	Body []byte
+}
+
+func (e *MaintenanceError) Error() string {
+	return fmt.Sprintf("upstream maintenance, response code: %d, json: %s", http.StatusServiceUnavailable, e.Body)
+}
+
+// checkResponse returns an error for any unsuccessful Ambient Weather API response code.
+func checkResponse(code int, body []byte) error {
+	switch code {
+	case http.StatusOK:
+		return nil
+	case http.StatusTooManyRequests:
+		// The ambient library doesn't expose response headers so a Retry-After header can't be read, but the
+		// documented rate limit window tells us when the limit resets.
+		return &RateLimitError{RetryAfter: ambientRateLimitWindow, Body: body}
+	case http.StatusServiceUnavailable:
+		return &MaintenanceError{Body: body}
+	default:
+		return fmt.Errorf("unexpected response code: %d, json: %s", code, body)
+	}
+}
+
+// decodeNumbers decodes an Ambient Weather API response body into v keeping numbers as json.Number. The ambient
+// library decodes numbers as float64, which can't exactly represent every large integer, so the raw body is decoded
+// again to keep values, and especially millisecond timestamps, exactly as the API sent them.
+func decodeNumbers(body []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// preciseLastData returns the last data fields of the device at index in a /devices response body decoded with
+// json.Number values, falling back to the ambient library's fields if the body can't be decoded.
+func preciseLastData(ctx context.Context, body []byte, index int, fallback map[string]any) map[string]any {
+	var devices []struct {
+		LastData map[string]any `json:"lastData"`
+	}
+	if err := decodeNumbers(body, &devices); err != nil || index >= len(devices) || devices[index].LastData == nil {
+		slog.DebugContext(ctx, "could not decode precise latest data, using ambient library's")
+		return fallback
+	}
+	return devices[index].LastData
+}
+
+// preciseRecords returns the records in a /devices/{mac} response body decoded with json.Number values, falling
+// back to the ambient library's records if the body can't be decoded.
+func preciseRecords(ctx context.Context, body []byte, fallback []map[string]any) []map[string]any {
+	var records []map[string]any
+	if err := decodeNumbers(body, &records); err != nil || len(records) != len(fallback) {
+		slog.DebugContext(ctx, "could not decode precise historical data, using ambient library's")
+		return fallback
+	}
+	return records
+}
+
+// dumpResponse writes a raw Ambient Weather API response body to a timestamped file in dir for offline analysis.
+// Failing to write it is logged rather than failing the update.
+func dumpResponse(ctx context.Context, dir, name string, body []byte) {
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.json", time.Now().UTC().Format("20060102T150405.000Z"), name))
+	err := os.MkdirAll(dir, 0o755)
+	if err == nil {
+		err = os.WriteFile(path, body, 0o644)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "could not dump Ambient Weather response", slog.String("path", path), slog.String("err", err.Error()))
+		return
+	}
+	slog.DebugContext(ctx, "dumped Ambient Weather response", slog.String("path", path), slog.Int("size_bytes", len(body)))
+}
+
 // MergeVariables contains the Ambient Weather API data used for templating in the TRMNL plugin.
 type MergeVariables struct {
 	Latest     map[string]any   `json:"latest"`
 	Historical []map[string]any `json:"historical"`
+	// HistoricalCoarse and HistoricalFine are the historical data bucketed coarsely over the full window and finely
+	// over the trailing fine window, omitted without a fine window.
+	HistoricalCoarse []map[string]any `json:"historicalCoarse,omitempty"`
+	HistoricalFine   []map[string]any `json:"historicalFine,omitempty"`
+	// HistoricalRaw is the unaggregated historical tempf and dateutc, omitted unless requested.
+	HistoricalRaw []map[string]any `json:"historicalRaw,omitempty"`
+	Meta          *Meta            `json:"meta,omitempty"`
+
+	// BatteryLow is true when any battery indicator reports low, omitted when the station reports no batteries.
+	BatteryLow *bool `json:"batteryLow,omitempty"`
+	// DataAgeSeconds is how many seconds old the latest reading is and Stale is true when that's longer than the
+	// configured threshold, e.g. because the station is offline. Both are omitted without a latest reading.
+	DataAgeSeconds *int64 `json:"dataAgeSeconds,omitempty"`
+	Stale          *bool  `json:"stale,omitempty"`
+	// TimeSinceRain is the number of seconds since it last rained, omitted when the station doesn't report it.
+	TimeSinceRain *int64 `json:"timeSinceRain,omitempty"`
+
+	// WindChill and HeatIndex are computed from the latest reading, each omitted outside the conditions it applies in:
+	// cold and windy for wind chill and hot for heat index.
+	WindChill *float64 `json:"windChill,omitempty"`
+	HeatIndex *float64 `json:"heatIndex,omitempty"`
+	// ComfortLevel labels how the latest reading feels, cold, hot, muggy, dry or comfortable, see comfortLevel.
+	// It's omitted without the latest temperature and humidity.
+	ComfortLevel string `json:"comfortLevel,omitempty"`
+	// Conditions is a short human summary of the latest reading, e.g. "Day, dry, 72°F, light breeze", see
+	// conditionsSummary. It's omitted unless requested.
+	Conditions string `json:"conditions,omitempty"`
+	// Sunrise and Sunset are today's ISO 8601 times in the configured timezone, omitted without coordinates or when
+	// the sun doesn't rise or set today.
+	Sunrise string `json:"sunrise,omitempty"`
+	Sunset  string `json:"sunset,omitempty"`
+	// IsDaytime is true between sunrise and sunset, omitted without coordinates.
+	IsDaytime *bool `json:"isDaytime,omitempty"`
+	// High24h and Low24h are the highest and lowest tempf over the 24 hours of raw historical records ending at the
+	// most recent one, with the ms timestamps they occurred at, omitted without historical data.
+	High24h   *float64 `json:"high24h,omitempty"`
+	High24hAt *int64   `json:"high24hAt,omitempty"`
+	Low24h    *float64 `json:"low24h,omitempty"`
+	Low24hAt  *int64   `json:"low24hAt,omitempty"`
+	// DegreeHours are the heating, or cooling, degree hours over the historical window, omitted without a base.
+	DegreeHours *float64 `json:"degreeHours,omitempty"`
+
+	// historicalLayout is how Historical is marshaled, see MarshalJSON.
+	historicalLayout string
+}
+
+// Historical layouts selectable with --historical-layout.
+const (
+	// historicalLayoutObjects marshals historical data as an array of records.
+	historicalLayoutObjects = "objects"
+	// historicalLayoutColumns marshals historical data as an object of parallel arrays, one per field.
+	historicalLayoutColumns = "columns"
+)
+
+// MarshalJSON marshals the merge variables, with historical data in columns when that layout was chosen.
+func (mv MergeVariables) MarshalJSON() ([]byte, error) {
+	type plain MergeVariables
+	if mv.historicalLayout != historicalLayoutColumns {
+		return json.Marshal(plain(mv))
+	}
+	// The outer historical field shadows the embedded one
+	return json.Marshal(struct {
+		plain
+		Historical map[string][]any `json:"historical"`
+	}{plain(mv), historicalColumns(mv.Historical)})
+}
+
+// historicalColumns returns records as parallel arrays, one per field, e.g. {"dateutc": [...], "tempf": [...]}.
+// Records without a field have null in its array so that every array lines up.
+func historicalColumns(records []map[string]any) map[string][]any {
+	columns := make(map[string][]any)
+	for i, record := range records {
+		for field, value := range record {
+			if _, ok := columns[field]; !ok {
+				columns[field] = make([]any, len(records))
+			}
+			columns[field][i] = value
+		}
+	}
+	return columns
+}
+
+// Meta describes the merge variables themselves rather than the weather.
+type Meta struct {
+	// Partial is true when either the latest or historical data couldn't be fetched and is empty.
+	Partial bool `json:"partial,omitempty"`
+	// DeviceName and DeviceLocation are the station's name and location as configured in the Ambient Weather app,
+	// omitted unless requested or when they aren't configured.
+	DeviceName     string `json:"deviceName,omitempty"`
+	DeviceLocation string `json:"deviceLocation,omitempty"`
 }
 
 // WebhookData wraps up the Ambient Weather API response in the webhook data format expected by TRMNL.
 type WebhookData struct {
 	MergeVariables MergeVariables `json:"merge_variables"`
+	// MergeStrategy tells TRMNL how to combine the merge variables with those it already has, e.g. "deep_merge".
+	// When empty TRMNL replaces the existing merge variables entirely.
+	MergeStrategy string `json:"merge_strategy,omitempty"`
 }
 
-// Latest requests the most recent data from the Ambient Weather API for the given device MAC address.
-func Latest(key ambient.Key, mac string) (map[string]any, error) {
-	slog.Info("getting latest weather data", slog.String("mac", mac))
-	results, err := ambient.Device(key)
+// Latest requests the most recent data from the Ambient Weather API for the given device MAC address. The device's
+// record is returned too, for its name and location as configured in the Ambient Weather app and its unfiltered last
+// data, decoded precisely and with the primary temperature applied.
+func Latest(ctx context.Context, key ambient.Key, mac string,
+	opts *DataFlags) (map[string]any, ambient.DeviceRecord, error) {
+	slog.InfoContext(ctx, "getting latest weather data", slog.String("mac", mac))
+	results, err := latestDevices(ctx, key, opts)
 	if err != nil {
-		slog.Error("could not get latest devices data", slog.String("err", err.Error()))
-		return nil, err
-	}
-	if results.HTTPResponseCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected response code: %d, json: %s", results.HTTPResponseCode, results.JSONResponse)
+		return nil, ambient.DeviceRecord{}, err
 	}
 
-	slog.Debug("latest", slog.Any("records", results))
+	// An empty response is sometimes a transient hiccup which succeeds on a quick retry
+	delay := max(opts.EmptyRetryDelay, ambientRateLimitWindow)
+	for attempt := 0; len(results.DeviceRecord) == 0 && attempt < opts.EmptyRetries; attempt++ {
+		slog.WarnContext(ctx, "received zero device records, retrying",
+			slog.Int("attempt", attempt+1),
+			slog.Duration("delay", delay))
+		if err := sleep(ctx, delay); err != nil {
+			return nil, ambient.DeviceRecord{}, err
+		}
+		if results, err = latestDevices(ctx, key, opts); err != nil {
+			return nil, ambient.DeviceRecord{}, err
+		}
+	}
 	if len(results.DeviceRecord) == 0 {
-		return nil, fmt.Errorf("received zero device records")
+		return nil, ambient.DeviceRecord{}, fmt.Errorf("received zero device records")
 	}
 
+	for i, r := range results.DeviceRecord {
+		if mac != r.Macaddress {
+			continue
+		}
+		lastData := preciseLastData(ctx, results.JSONResponse, i, r.LastDataFields)
+		opts.primaryTemp(lastData)
+		latest := filterLatest(ctx, lastData, opts)
+		// An empty display is confusing so make a firmware or --include-field mismatch obvious
+		fields := slices.DeleteFunc(opts.effectiveFields(defaultLatestFields), func(field string) bool { return field == "dateutc" })
+		if !slices.ContainsFunc(fields, func(field string) bool { _, ok := latest[field]; return ok }) {
+			return nil, ambient.DeviceRecord{}, fmt.Errorf(
+				"device %s returned data but none of the expected fields: %s, it reported: %s", mac, strings.Join(fields, ", "), strings.Join(slices.Sorted(maps.Keys(lastData)), ", "))
+		}
+		r.LastDataFields = lastData
+		return latest, r, nil
+	}
+	return nil, ambient.DeviceRecord{}, fmt.Errorf("no device data found for device MAC: %s", mac)
+}
+
+// latestDevices requests every device's latest data from the Ambient Weather API.
+func latestDevices(ctx context.Context, key ambient.Key, opts *DataFlags) (ambient.APIDeviceResponse, error) {
+	results, err := callAmbient(ctx, func() (ambient.APIDeviceResponse, error) { return ambient.Device(key) })
+	if err != nil {
+		slog.ErrorContext(ctx, "could not get latest devices data", slog.String("err", err.Error()))
+		return results, err
+	}
+	if opts.DumpAmbient != "" {
+		dumpResponse(ctx, opts.DumpAmbient, "devices", results.JSONResponse)
+	}
+	if err := checkResponse(results.HTTPResponseCode, results.JSONResponse); err != nil {
+		return results, err
+	}
+
+	slog.DebugContext(ctx, "latest", slog.Any("records", results))
+	return results, nil
+}
+
+// defaultLatestFields are the latest fields sent to TRMNL before any are included or excluded with flags.
+var defaultLatestFields = []string{"tempf", "feelsLike", "humidity", "dailyrainin", "dateutc"}
+
+// fieldAliases are other names, in order of preference, that station firmware may report latest fields by.
+var fieldAliases = map[string][]string{
+	"feelsLike": {"feelslike", "apparentTemp"},
+}
+
+// rainTotalFields are the cumulative rain totals added to the latest fields with --rain-totals. Being cumulative
+// they're only meaningful as the latest values so they're never averaged into historical data.
+var rainTotalFields = []string{"weeklyrainin", "monthlyrainin", "yearlyrainin"}
+
+// defaultHistoricalFields are the historical fields averaged per bucket before any are included or excluded with flags.
+var defaultHistoricalFields = []string{"tempf"}
+
+// effectiveFields adds the included fields to base and removes the excluded ones. Excluded fields take precedence.
+func (f *DataFlags) effectiveFields(base []string) []string {
+	fields := make([]string, 0, len(base)+len(f.IncludeField))
+	for _, field := range slices.Concat(base, f.IncludeField) {
+		if !slices.Contains(fields, field) && !slices.Contains(f.ExcludeField, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// primaryTemp replaces a raw record's tempf with the configured primary temperature field, e.g. an add-on sensor's
+// temp1f, so that everything built on tempf uses it. Without the field tempf is removed rather than mixing sensors.
+func (f *DataFlags) primaryTemp(record map[string]any) {
+	if f.PrimaryTempField == "" || f.PrimaryTempField == "tempf" {
+		return
+	}
+	if value, ok := record[f.PrimaryTempField]; ok {
+		record["tempf"] = value
+	} else {
+		delete(record, "tempf")
+	}
+}
+
+// filterLatest copies only the fields needed by the TRMNL plugin from a device's last data fields.
+func filterLatest(ctx context.Context, lastData map[string]any, opts *DataFlags) map[string]any {
 	// Pre-allocate the map with exact capacity needed
-	fields := []string{"tempf", "feelsLike", "humidity", "dailyrainin", "dateutc"}
+	fields := opts.effectiveFields(defaultLatestFields)
+	if opts.RainTotals {
+		fields = append(fields, rainTotalFields...)
+	}
 	filteredData := make(map[string]any, len(fields))
+	slog.DebugContext(ctx, "effective latest fields", slog.Any("fields", fields))
 
-	for _, r := range results.DeviceRecord {
-		if mac == r.Macaddress {
-			// Only copy the fields we need
-			for _, field := range fields {
-				if value, exists := r.LastDataFields[field]; exists {
-					filteredData[field] = value
-				}
+	// Only copy the fields we need, falling back to other names some firmware reports them by
+	for _, field := range fields {
+		for _, name := range append([]string{field}, fieldAliases[field]...) {
+			if value, exists := lastData[name]; exists {
+				filteredData[field] = value
+				break
 			}
-			return filteredData, nil
 		}
 	}
-	return nil, fmt.Errorf("no device data found for device MAC: %s", mac)
+
+	// Override the station provided value when another model is selected, or compute it when the station didn't
+	// provide one
+	if value, ok := feelsLike(opts.FeelsLikeModel, lastData); ok {
+		opts.setRounded(filteredData, "feelsLike", value)
+	} else if _, exists := filteredData["feelsLike"]; !exists && slices.Contains(fields, "feelsLike") {
+		if value, ok := feelsLike(feelsLikeApparent, lastData); ok {
+			opts.setRounded(filteredData, "feelsLike", value)
+		}
+	}
+
+	// Feels like adds nothing when it's effectively the actual temperature
+	if opts.SuppressRedundantFeelslike {
+		feels, feelsOK := float64Field(filteredData, "feelsLike")
+		temp, tempOK := float64Field(filteredData, "tempf")
+		if feelsOK && tempOK && math.Abs(feels-temp) <= opts.FeelslikeDelta {
+			slog.DebugContext(ctx, "dropping redundant feelsLike", slog.Float64("feelsLike", feels), slog.Float64("tempf", temp))
+			deleteField(filteredData, "feelsLike")
+		}
+	}
+
+	if opts.Indoor {
+		addIndoor(filteredData, lastData, opts.IndoorNamespace)
+	}
+
+	// Normalize the last rain time to a millisecond timestamp like dateutc
+	if lastRain, ok := timeField(lastData, "lastRain"); ok {
+		filteredData["lastRain"] = lastRain.UnixMilli()
+	}
+
+	// Battery indicators vary by sensor, e.g. battout, battin, batt1
+	for field, value := range lastData {
+		if isBatteryField(field) {
+			filteredData[field] = value
+		}
+	}
+
+	// Station values are sent as is unless a precision was given for them
+	for field := range opts.Precision {
+		if value, ok := float64Field(filteredData, field); ok {
+			opts.setRounded(filteredData, field, value)
+		}
+	}
+
+	// Excluded fields take precedence over everything added above
+	for _, field := range opts.ExcludeField {
+		deleteField(filteredData, field)
+	}
+	return filteredData
 }
 
-// hourlyBucket holds data for calculating hourly averages
-type hourlyBucket struct {
-	Sum   float64
-	Count int
-	First int64 // Store the first timestamp in the hour (in milliseconds)
+// indoorFields maps indoor sensor fields to the equivalent outdoor field names used when namespaced.
+var indoorFields = map[string]string{
+	"tempinf":    "tempf",
+	"humidityin": "humidity",
+}
+
+// addIndoor copies indoor sensor fields into filteredData. When namespaced they're nested under "indoor" using the
+// outdoor field names, e.g. indoor.tempf, so templates can treat indoor and outdoor readings alike.
+func addIndoor(filteredData, lastData map[string]any, namespace bool) {
+	indoor := make(map[string]any, len(indoorFields))
+	for field, name := range indoorFields {
+		value, exists := lastData[field]
+		if !exists {
+			continue
+		}
+		if namespace {
+			indoor[name] = value
+		} else {
+			filteredData[field] = value
+		}
+	}
+	if namespace && len(indoor) > 0 {
+		filteredData["indoor"] = indoor
+	}
+}
+
+// defaultBucketInterval is the interval historical data is averaged over unless configured otherwise.
+const defaultBucketInterval = time.Hour
+
+// historicalBucket holds data for calculating averages over a bucket interval
+type historicalBucket struct {
+	Sums        map[string]float64 // Sum of each field's values
+	Counts      map[string]int     // Number of values summed for each field
+	Count       int                // Number of samples in the bucket
+	Start       int64              // Start timestamp of the bucket interval, rounded down to the interval (in milliseconds)
+	FirstSample int64              // Timestamp of the earliest sample in the bucket (in milliseconds)
+
+	Samples []historicalSample // Samples in the bucket, only kept for time weighted averages
+}
+
+// timeWeightedAverage averages a field's values in the bucket weighting each by the time until the next sample, or
+// until endMs for the last sample, so irregularly reported values count for as long as they were current.
+func (b *historicalBucket) timeWeightedAverage(field string, endMs int64) float64 {
+	samples := slices.SortedFunc(slices.Values(b.Samples), func(a, b historicalSample) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+
+	var weightedSum, totalWeight float64
+	for i, sample := range samples {
+		value, ok := sample.Values[field]
+		if !ok {
+			continue
+		}
+		nextMs := endMs
+		if i+1 < len(samples) {
+			nextMs = samples[i+1].Timestamp
+		}
+		weight := float64(nextMs - sample.Timestamp)
+		weightedSum += value * weight
+		totalWeight += weight
+	}
+
+	// Samples all at the very end of the bucket carry no weight so fall back to a simple mean
+	if totalWeight == 0 {
+		return b.Sums[field] / float64(b.Counts[field])
+	}
+	return weightedSum / totalWeight
+}
+
+// historicalSample is a single parsed historical record
+type historicalSample struct {
+	Timestamp int64 // Milliseconds
+	Values    map[string]float64
 }
 
 // Historical requests past data from the Ambient Weather API for a single device.
-// Returns hourly temperature averages with timestamps, reducing the data volume.
-// Each returned record contains the average tempf for that hour and the dateutc for the start of the hour.
-// Assumes dateutc is in millisecond timestamp format (e.g., 1742535660000)
-func Historical(key ambient.Key, mac string, limit int64) ([]map[string]any, error) {
-	slog.Info("getting historical weather data", slog.String("mac", mac), slog.Int64("records", limit))
+// Returns the raw records, see bucketHistorical for reducing their volume.
+func Historical(ctx context.Context, key ambient.Key, mac string, opts *DataFlags) ([]map[string]any, error) {
+	limit := opts.ResultsLimit
+	slog.InfoContext(ctx, "getting historical weather data", slog.String("mac", mac), slog.Int64("records", limit))
 	now := time.Now().UTC()
-	results, err := ambient.DeviceMac(key, mac, now, limit)
+	results, err := callAmbient(ctx, func() (ambient.APIDeviceMacResponse, error) {
+		return ambient.DeviceMac(key, mac, now, limit)
+	})
 	if err != nil {
-		slog.Error("could not get historical device data", slog.String("err", err.Error()))
+		slog.ErrorContext(ctx, "could not get historical device data", slog.String("err", err.Error()))
+		return nil, err
+	}
+	if opts.DumpAmbient != "" {
+		dumpResponse(ctx, opts.DumpAmbient, "device-"+strings.ReplaceAll(mac, ":", ""), results.JSONResponse)
+	}
+	if err := checkResponse(results.HTTPResponseCode, results.JSONResponse); err != nil {
 		return nil, err
 	}
-	if results.HTTPResponseCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected response code: %d, json: %s", results.HTTPResponseCode, results.JSONResponse)
+
+	results.RecordFields = preciseRecords(ctx, results.JSONResponse, results.RecordFields)
+	for _, record := range results.RecordFields {
+		opts.primaryTemp(record)
+	}
+
+	// Ambient Weather returns the most recent records first so keeping the head keeps the most recent
+	if maxRecords := opts.MaxProcessRecords; maxRecords > 0 && len(results.RecordFields) > maxRecords {
+		slog.WarnContext(ctx, "truncating historical records",
+			slog.Int("records", len(results.RecordFields)),
+			slog.Int("max_process_records", maxRecords))
+		results.RecordFields = results.RecordFields[:maxRecords]
 	}
 
 	// Log only a sample of records to reduce memory usage
-	recordCount := len(results.RecordFields)
-	if recordCount > 10 {
-		sampleRecords := results.RecordFields[recordCount-10:]
-		slog.Debug("historical sample",
-			slog.Int("total_records", recordCount),
-			slog.Any("sample_records", sampleRecords))
+	if sample := sampleRecords(results.RecordFields, opts.DebugSampleRecords, opts.DebugSampleFrom); len(sample) > 0 {
+		slog.DebugContext(ctx, "historical sample",
+			slog.Int("total_records", len(results.RecordFields)),
+			slog.String("sample_from", opts.DebugSampleFrom),
+			slog.Any("sample_records", sample))
 	}
 
-	// Estimate map size to avoid rehashing
-	// Assume 1 record per hour for the last X hours as a reasonable estimate
-	estimatedHours := min(24, int(limit/12)) // Assuming ~12 records per hour
-	hourlyBuckets := make(map[string]*hourlyBucket, estimatedHours)
+	return results.RecordFields, nil
+}
 
-	for _, record := range results.RecordFields {
-		// Extract temperature and date only once
-		tempValue, hasTempf := record["tempf"]
-		dateValue, hasDate := record["dateutc"]
-		if !hasTempf || !hasDate {
-			continue
-		}
+// bucketHistorical reduces raw historical records to averages per bucket interval (hourly by default) sorted by
+// timestamp ascending. Each returned record contains the average tempf, and any other historical fields, for that
+// bucket and the dateutc for the start of the bucket. The bucket interval used is returned too.
+// Assumes dateutc is in millisecond timestamp format (e.g., 1742535660000)
+func bucketHistorical(ctx context.Context, records []map[string]any,
+	opts *DataFlags) ([]map[string]any, time.Duration) {
+	fields := opts.effectiveFields(defaultHistoricalFields)
+	samples := parseSamples(ctx, records, fields)
+	interval := opts.bucketInterval(samples)
+	if len(samples) == 0 {
+		return []map[string]any{}, interval
+	}
+
+	intervalMs := interval.Milliseconds()
+	slog.DebugContext(ctx, "bucketing historical data", slog.Duration("interval", interval), slog.Any("fields", fields))
 
-		// Parse timestamp more efficiently
-		var timestampMs int64
-		switch v := dateValue.(type) {
-		case float64:
-			timestampMs = int64(v)
-		case int64:
-			timestampMs = v
-		case json.Number:
-			timestampMs, err = v.Int64()
-			if err != nil {
-				continue
+	// Estimate map size to avoid rehashing from the samples actually received, which may be far fewer than requested
+	// for a new station, as the number of intervals they span but no more than one bucket per sample
+	first, last := samples[0].Timestamp, samples[0].Timestamp
+	for _, sample := range samples {
+		first = min(first, sample.Timestamp)
+		last = max(last, sample.Timestamp)
+	}
+	estimatedBuckets := int(min(int64(len(samples)), (last-first)/intervalMs+1))
+	buckets := make(map[int64]*historicalBucket, estimatedBuckets)
+	// order lists the bucket starts so that output doesn't depend on map iteration order
+	order := make([]int64, 0, estimatedBuckets)
+
+	for _, sample := range samples {
+		// Round down to the start of the bucket interval
+		bucketStartMs := (sample.Timestamp / intervalMs) * intervalMs
+
+		// Add to bucket, creating if needed
+		bucket, exists := buckets[bucketStartMs]
+		if !exists {
+			bucket = &historicalBucket{
+				Sums:        make(map[string]float64, len(fields)),
+				Counts:      make(map[string]int, len(fields)),
+				Start:       bucketStartMs,
+				FirstSample: sample.Timestamp,
 			}
-		case string:
-			timestampMs, err = strconv.ParseInt(v, 10, 64)
-			if err != nil {
-				continue
+			buckets[bucketStartMs] = bucket
+			order = append(order, bucketStartMs)
+		}
+		for field, value := range sample.Values {
+			bucket.Sums[field] += value
+			bucket.Counts[field]++
+		}
+		bucket.Count++
+		bucket.FirstSample = min(bucket.FirstSample, sample.Timestamp)
+		if opts.TimeWeighted {
+			bucket.Samples = append(bucket.Samples, sample)
+		}
+	}
+
+	logEmptiedBuckets(ctx, records, buckets, intervalMs)
+
+	var rain map[int64]float64
+	if opts.RainHour {
+		rain = rainPerBucket(ctx, records, intervalMs)
+	}
+
+	// Create result records from buckets with pre-allocation
+	nowMs := time.Now().UnixMilli()
+	bucketedRecords := make([]map[string]any, 0, len(buckets))
+
+	// Sort by the numeric bucket start rather than the output dateutc so the order doesn't depend on how
+	// timestamps are formatted. Bucket starts are unique so the order is deterministic.
+	slices.Sort(order)
+
+	dropped := 0
+	for _, bucketStartMs := range order {
+		bucket := buckets[bucketStartMs]
+		// Sparse buckets, e.g. a single reading at an interval boundary, can be misleading
+		if bucket.Count < opts.MinBucketSamples {
+			dropped++
+			continue
+		}
+		// Only allocate the fields we need
+		record := make(map[string]any, len(bucket.Sums)+1)
+		for field, sum := range bucket.Sums {
+			average := sum / float64(bucket.Counts[field])
+			if opts.TimeWeighted {
+				average = bucket.timeWeightedAverage(field, bucket.Start+intervalMs)
 			}
-		default:
+			opts.setRounded(record, field, average)
+		}
+		if total, ok := rain[bucket.Start]; ok {
+			record["rainHour"] = opts.roundRain("rainHour", total)
+		}
+		record["dateutc"] = bucket.Start
+		if opts.BucketTimestamp == bucketTimestampFirstSample {
+			record["dateutc"] = bucket.FirstSample
+		}
+		// The current bucket's interval isn't over so its average is based on fewer samples than the others
+		if bucket.Start+intervalMs > nowMs {
+			record["incomplete"] = true
+			record["samples"] = bucket.Count
+		}
+
+		bucketedRecords = append(bucketedRecords, record)
+	}
+
+	if dropped > 0 {
+		slog.DebugContext(ctx, "dropped sparse historical buckets",
+			slog.Int("dropped", dropped),
+			slog.Int("min_bucket_samples", opts.MinBucketSamples))
+	}
+
+	return bucketedRecords, interval
+}
+
+// logEmptiedBuckets warns about bucket intervals which had readings but no bucket because every reading in them was
+// dropped as unparseable, so they aren't mistaken for the station not reporting.
+func logEmptiedBuckets(ctx context.Context, records []map[string]any, buckets map[int64]*historicalBucket, intervalMs int64) {
+	emptied := make(map[int64]int)
+	dropped := 0
+	for _, record := range records {
+		timestampMs, ok := timestampField(record, "dateutc")
+		if !ok {
+			continue
+		}
+		bucketStartMs := (timestampMs / intervalMs) * intervalMs
+		if _, exists := buckets[bucketStartMs]; !exists {
+			emptied[bucketStartMs]++
+			dropped++
+		}
+	}
+	if len(emptied) == 0 {
+		return
+	}
+
+	starts := slices.Sorted(maps.Keys(emptied))
+	slog.WarnContext(ctx, "historical buckets empty after dropping unparseable readings",
+		slog.Int("buckets", len(emptied)),
+		slog.Int("dropped_readings", dropped),
+		slog.Time("first_bucket", time.UnixMilli(starts[0]).UTC()))
+}
+
+// rainPerBucket returns how much rain fell in each bucket interval, keyed by bucket start, from the increases in the
+// raw records' cumulative dailyrainin. When dailyrainin drops, at the station's midnight reset, the new value is
+// what fell since the reset.
+func rainPerBucket(ctx context.Context, records []map[string]any, intervalMs int64) map[int64]float64 {
+	samples := parseSamples(ctx, records, []string{"dailyrainin"})
+	slices.SortFunc(samples, func(a, b historicalSample) int { return cmp.Compare(a.Timestamp, b.Timestamp) })
+
+	rain := make(map[int64]float64)
+	for i, sample := range samples {
+		bucketStartMs := (sample.Timestamp / intervalMs) * intervalMs
+		// Every bucket with a reading has an amount, even when no rain fell
+		rain[bucketStartMs] += 0
+		if i == 0 {
+			// What fell before the first sample is unknown
 			continue
 		}
+		increase := sample.Values["dailyrainin"] - samples[i-1].Values["dailyrainin"]
+		if increase < 0 {
+			increase = sample.Values["dailyrainin"]
+		}
+		rain[bucketStartMs] += increase
+	}
+	return rain
+}
 
-		// Convert to time.Time only once
-		dateTime := time.Unix(timestampMs/1000, 0).UTC()
+// parseSamples extracts the timestamp and numeric fields from raw historical records, skipping records without a
+// timestamp or any of the fields. Missing, or empty, fields are told apart from malformed ones in debug logs.
+func parseSamples(ctx context.Context, records []map[string]any, fields []string) []historicalSample {
+	samples := make([]historicalSample, 0, len(records))
 
-		// Format time string once - avoid repeated string formatting
-		hourKey := dateTime.Format("2006-01-02 15:00")
+	for _, record := range records {
+		timestampMs, ok := timestampField(record, "dateutc")
+		if !ok {
+			logUnparsedField(ctx, record, "dateutc")
+			continue
+		}
 
-		// Get temperature efficiently
-		var tempf float64
-		switch t := tempValue.(type) {
-		case float64:
-			tempf = t
-		case int:
-			tempf = float64(t)
-		case json.Number:
-			tempf, err = t.Float64()
-			if err != nil {
-				continue
-			}
-		case string:
-			tempf, err = strconv.ParseFloat(t, 64)
-			if err != nil {
-				continue
+		values := make(map[string]float64, len(fields))
+		for _, field := range fields {
+			if value, ok := float64Field(record, field); ok {
+				values[field] = value
+			} else {
+				logUnparsedField(ctx, record, field)
 			}
-		default:
+		}
+		if len(values) == 0 {
 			continue
 		}
 
-		// Add to bucket, creating if needed
-		bucket, exists := hourlyBuckets[hourKey]
-		if !exists {
-			// Compute hour start timestamp efficiently
-			hourStartMs := (timestampMs / 3600000) * 3600000 // Round down to the nearest hour
-			bucket = &hourlyBucket{First: hourStartMs}
-			hourlyBuckets[hourKey] = bucket
+		samples = append(samples, historicalSample{Timestamp: timestampMs, Values: values})
+	}
+	return samples
+}
+
+// logUnparsedField logs why a historical record's field couldn't be parsed.
+func logUnparsedField(ctx context.Context, record map[string]any, field string) {
+	if missingField(record, field) {
+		slog.DebugContext(ctx, "historical record field missing", slog.String("field", field))
+		return
+	}
+	slog.DebugContext(ctx, "historical record field malformed", slog.String("field", field), slog.Any("value", record[field]))
+}
+
+// bucketInterval returns the interval historical samples are averaged over. When HistoricalPoints is set the
+// interval is chosen so that roughly that many buckets evenly span the samples, otherwise, or without samples,
+// BucketInterval is used.
+func (f *DataFlags) bucketInterval(samples []historicalSample) time.Duration {
+	if f.HistoricalPoints == 0 || len(samples) == 0 {
+		if f.BucketInterval == 0 {
+			return defaultBucketInterval
 		}
-		bucket.Sum += tempf
-		bucket.Count++
+		return max(f.BucketInterval, time.Minute)
 	}
 
-	// Create result records from buckets with pre-allocation
-	bucketedRecords := make([]map[string]any, 0, len(hourlyBuckets))
+	first, last := samples[0].Timestamp, samples[0].Timestamp
+	for _, sample := range samples {
+		first = min(first, sample.Timestamp)
+		last = max(last, sample.Timestamp)
+	}
+	span := time.Duration(last-first) * time.Millisecond
+	return max((span / time.Duration(f.HistoricalPoints)).Round(time.Minute), time.Minute)
+}
+
+// Bucket timestamps selectable with --bucket-timestamp.
+const (
+	// bucketTimestampStart timestamps buckets with the start of their interval, e.g. the top of the hour.
+	bucketTimestampStart = "start"
+	// bucketTimestampFirstSample timestamps buckets with their earliest sample's timestamp.
+	bucketTimestampFirstSample = "first-sample"
+)
+
+// Debug sample positions selectable with --debug-sample-from.
+const (
+	debugSampleStart  = "start"
+	debugSampleMiddle = "middle"
+	debugSampleEnd    = "end"
+)
+
+// sampleRecords returns up to n consecutive records taken from the start, middle or end of records.
+func sampleRecords(records []map[string]any, n int, from string) []map[string]any {
+	if n <= 0 {
+		return nil
+	}
+	if n >= len(records) {
+		return records
+	}
+	switch from {
+	case debugSampleStart:
+		return records[:n]
+	case debugSampleMiddle:
+		start := (len(records) - n) / 2
+		return records[start : start+n]
+	default:
+		return records[len(records)-n:]
+	}
+}
+
+// Historical orders selectable with --historical-order.
+const (
+	historicalOrderAsc  = "asc"
+	historicalOrderDesc = "desc"
+)
+
+// Rounding modes selectable with --rounding.
+const (
+	roundingNearest = "nearest"
+	roundingFloor   = "floor"
+	roundingCeil    = "ceil"
+)
+
+// roundTo rounds v to the given number of decimal places using the rounding mode, nearest by default.
+// Negative zero is normalized to zero so that sub-zero values like -0.04 aren't emitted as "-0".
+func roundTo(v float64, places int, mode string) float64 {
+	scale := math.Pow(10, float64(places))
+	// Remove floating point noise, e.g. 0.29*100 = 28.999999999999996, so it can't tip floor or ceil a step over
+	scaled := math.Round(v*scale*1e6) / 1e6
+
+	var rounded float64
+	switch mode {
+	case roundingFloor:
+		rounded = math.Floor(scaled) / scale
+	case roundingCeil:
+		rounded = math.Ceil(scaled) / scale
+	default:
+		rounded = math.Round(scaled) / scale
+	}
+	if rounded == 0 {
+		return 0
+	}
+	return rounded
+}
+
+// round rounds a field's output value to the field's configured precision, or the default precision, using the
+// configured rounding mode.
+func (f *DataFlags) round(field string, v float64) float64 {
+	places, ok := f.Precision[field]
+	if !ok {
+		places = f.DefaultPrecision
+	}
+	return roundTo(v, places, f.Rounding)
+}
 
-	for _, bucket := range hourlyBuckets {
-		if bucket.Count > 0 {
-			// Round to 1 decimal place for temperature
-			avgTemp := math.Round((bucket.Sum/float64(bucket.Count))*10) / 10
+// setRounded sets a field in record to v rounded, see round. With --fahrenheit-and-celsius a temperature field's
+// Celsius equivalent is converted from v before it's rounded, so rounding errors don't compound, e.g. 72.24°F is
+// 22.4°C rather than the 22.3°C that converting the rounded 72.2°F would give.
+func (f *DataFlags) setRounded(record map[string]any, field string, v float64) {
+	record[field] = f.round(field, v)
+	if name, ok := celsiusField(field); ok && f.FahrenheitAndCelsius {
+		record[name] = f.round(name, fahrenheitToCelsius(v))
+	}
+}
 
-			// Only allocate the fields we need
-			record := make(map[string]any, 2)
-			record["tempf"] = avgTemp
-			record["dateutc"] = bucket.First
+// roundRain rounds a rain amount in inches to the field's configured precision, or to hundredths since the default
+// precision would hide typical amounts, using the configured rounding mode.
+func (f *DataFlags) roundRain(field string, v float64) float64 {
+	places, ok := f.Precision[field]
+	if !ok {
+		places = 2
+	}
+	return roundTo(v, places, f.Rounding)
+}
+
+// deleteField deletes a field from record along with any Celsius equivalent setRounded added for it.
+func deleteField(record map[string]any, field string) {
+	delete(record, field)
+	if name, ok := celsiusField(field); ok {
+		delete(record, name)
+	}
+}
 
-			bucketedRecords = append(bucketedRecords, record)
+// integers replaces the values of the configured integer fields in record with rounded integers so they're sent as
+// JSON integers, e.g. 65 rather than 65.0, whatever precision the station reported them with.
+func (f *DataFlags) integers(record map[string]any) {
+	for _, field := range f.IntegerField {
+		if value, ok := float64Field(record, field); ok {
+			record[field] = int64(roundTo(value, 0, f.Rounding))
 		}
 	}
+}
 
-	// Sort by timestamp ascending, reusing the slice
-	sort.Slice(bucketedRecords, func(i, j int) bool {
-		timeI := bucketedRecords[i]["dateutc"].(int64)
-		timeJ := bucketedRecords[j]["dateutc"].(int64)
-		return timeI < timeJ
-	})
+// historicalCache holds the most recently fetched raw historical records so they can be reused between refreshes
+// when historical data is refreshed less often than the latest data, see --historical-refresh.
+type historicalCache struct {
+	mu        sync.Mutex
+	mac       string
+	records   []map[string]any
+	fetchedAt time.Time
+}
 
-	slog.Info("bucketed historical data",
-		slog.Int("original_count", recordCount),
-		slog.Int("bucketed_count", len(bucketedRecords)))
+// cachedHistorical is the historical cache shared by every update. It's empty on startup.
+var cachedHistorical historicalCache
+
+// get returns the cached records for the device if they're younger than maxAge.
+func (c *historicalCache) get(mac string, maxAge time.Duration) ([]map[string]any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.records == nil || c.mac != mac || time.Since(c.fetchedAt) >= maxAge {
+		return nil, false
+	}
+	return c.records, true
+}
 
-	return bucketedRecords, nil
+// set caches freshly fetched records for the device.
+func (c *historicalCache) set(mac string, records []map[string]any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mac, c.records, c.fetchedAt = mac, records, time.Now()
 }
 
 // Data assembles latest and historical data into something that can be sent to the TRMNL webhook URL.
-func Data(key ambient.Key, mac string, limit int64) (*WebhookData, error) {
-	latest, err := Latest(key, mac)
-	if err != nil {
-		return nil, err
+func Data(ctx context.Context, key ambient.Key, mac string, opts *DataFlags) (*WebhookData, error) {
+	var partial bool
+
+	latest, device, latestErr := Latest(ctx, key, mac, opts)
+	if latestErr != nil {
+		if !opts.PartialOK {
+			return nil, latestErr
+		}
+		slog.WarnContext(ctx, "failed to get latest data, continuing without it", slog.String("err", latestErr.Error()))
+		latest = map[string]any{}
+		partial = true
 	}
 
-	// HACK work around ridiculous immediate 429 response for making >1 request in a second
-	// "API requests are capped at 1 request/second for each user's apiKey and 3 requests/second per applicationKey."
-	// -- https://ambientweather.docs.apiary.io/#introduction/rate-limiting
-	// TODO remove this hack with a proper retry
-	time.Sleep(time.Second)
+	records, cached := cachedHistorical.get(mac, opts.HistoricalRefresh)
+	if cached {
+		slog.DebugContext(ctx, "reusing cached historical data", slog.Int("records", len(records)))
+	} else {
+		// Give the rate limit a chance to reset after the latest data request
+		if err := sleep(ctx, ambientRateLimitWindow); err != nil {
+			return nil, err
+		}
 
-	historical, err := Historical(key, mac, limit)
-	if err != nil {
-		return nil, err
+		var err error
+		records, err = Historical(ctx, key, mac, opts)
+		if err != nil {
+			if !opts.PartialOK || partial {
+				return nil, errors.Join(latestErr, err)
+			}
+			slog.WarnContext(ctx, "failed to get historical data, continuing without it", slog.String("err", err.Error()))
+			records = []map[string]any{}
+			partial = true
+		} else if opts.HistoricalRefresh > 0 {
+			cachedHistorical.set(mac, records)
+		}
+	}
+
+	data := newWebhookData(ctx, latest, device.LastDataFields, records, opts)
+	meta := Meta{Partial: partial}
+	if opts.DeviceInfo {
+		meta.DeviceName, meta.DeviceLocation = device.Info.Name, device.Info.Location
 	}
+	if meta != (Meta{}) {
+		data.MergeVariables.Meta = &meta
+	}
+	return data, nil
+}
+
+// newWebhookData assembles the latest data and raw historical records into WebhookData. Historical records are
+// bucketed, and padded when there aren't enough of them, and derived merge variables are computed.
+func newWebhookData(ctx context.Context, latest, lastData map[string]any, records []map[string]any,
+	opts *DataFlags) *WebhookData {
+	if opts.LatestAverage > 0 {
+		latest = averageLatest(ctx, latest, records, opts)
+	} else if opts.LatestEmaAlpha > 0 {
+		latest = emaLatest(ctx, latest, records, opts)
+	}
+
+	historical, interval := bucketHistorical(ctx, records, opts)
+	slog.InfoContext(ctx, "bucketed historical data",
+		slog.Int("original_count", len(records)),
+		slog.Int("bucketed_count", len(historical)))
 
-	return &WebhookData{
+	if len(historical) < opts.MinHistorical {
+		slog.DebugContext(ctx, "padding historical data with latest reading",
+			slog.Int("bucketed_count", len(historical)),
+			slog.Int("min_historical", opts.MinHistorical))
+		historical = padHistorical(historical, latest, interval, opts)
+	}
+
+	// Buckets are oldest first so the most recent are at the end
+	if opts.MaxBuckets > 0 && len(historical) > opts.MaxBuckets {
+		slog.DebugContext(ctx, "trimming historical data to the most recent buckets",
+			slog.Int("bucketed_count", len(historical)),
+			slog.Int("max_buckets", opts.MaxBuckets))
+		historical = historical[len(historical)-opts.MaxBuckets:]
+	}
+
+	data := &WebhookData{
 		MergeVariables: MergeVariables{
-			Latest:     latest,
-			Historical: historical,
+			Latest:           latest,
+			Historical:       historical,
+			historicalLayout: opts.HistoricalLayout,
 		},
-	}, nil
+	}
+	if opts.FineWindow > 0 {
+		data.MergeVariables.HistoricalCoarse, data.MergeVariables.HistoricalFine = coarseAndFineHistorical(ctx, records, opts)
+	}
+
+	if opts.HistoricalRaw {
+		data.MergeVariables.HistoricalRaw = rawHistorical(ctx, records, opts.HistoricalRawMax)
+	}
+
+	series := [][]map[string]any{historical, data.MergeVariables.HistoricalCoarse, data.MergeVariables.HistoricalFine,
+		data.MergeVariables.HistoricalRaw}
+	if opts.FahrenheitAndCelsius {
+		opts.addCelsius(latest)
+		for _, records := range series {
+			for _, record := range records {
+				opts.addCelsius(record)
+			}
+		}
+	}
+	if opts.LocalTimestamps {
+		location := opts.location()
+		addLocalTimestamp(latest, location)
+		for _, records := range series {
+			for _, record := range records {
+				addLocalTimestamp(record, location)
+			}
+		}
+	}
+	if opts.WindUnits {
+		opts.addWindUnits(latest)
+		for _, records := range series {
+			for _, record := range records {
+				opts.addWindUnits(record)
+			}
+		}
+	}
+	if len(opts.IntegerField) > 0 {
+		opts.integers(latest)
+		for _, records := range series {
+			for _, record := range records {
+				opts.integers(record)
+			}
+		}
+	}
+
+	if opts.HistoricalOrder == historicalOrderDesc {
+		slices.Reverse(data.MergeVariables.HistoricalRaw)
+		slices.Reverse(data.MergeVariables.Historical)
+		slices.Reverse(data.MergeVariables.HistoricalCoarse)
+		slices.Reverse(data.MergeVariables.HistoricalFine)
+	}
+
+	derive(ctx, &data.MergeVariables, lastData, opts)
+	if extremes, ok := rollingHighLow(ctx, records, 24*time.Hour); ok {
+		if !extremes.Covered {
+			slog.WarnContext(ctx, "historical data covers less than 24 hours, high24h and low24h are over a shorter window",
+				slog.Int64("results_limit", opts.ResultsLimit))
+		}
+		high, low := opts.round("tempf", extremes.High), opts.round("tempf", extremes.Low)
+		data.MergeVariables.High24h, data.MergeVariables.High24hAt = &high, &extremes.HighAt
+		data.MergeVariables.Low24h, data.MergeVariables.Low24hAt = &low, &extremes.LowAt
+	}
+	if opts.DegreeBase != nil {
+		if total := degreeHours(ctx, records, *opts.DegreeBase, opts.DegreeMode); total != nil {
+			rounded := opts.round("degreeHours", *total)
+			data.MergeVariables.DegreeHours = &rounded
+		}
+	}
+	return data
 }
 
-func Update(key ambient.Key, mac string, limit int64, webhook *url.URL) error {
-	data, err := Data(key, mac, limit)
-	if err != nil {
-		return err
+// medianReportingGap returns the median time between consecutive raw historical records, which is how often the
+// station reports. It returns false when there are fewer than two timestamped records.
+func medianReportingGap(records []map[string]any) (time.Duration, bool) {
+	timestamps := make([]int64, 0, len(records))
+	for _, record := range records {
+		if timestampMs, ok := timestampField(record, "dateutc"); ok {
+			timestamps = append(timestamps, timestampMs)
+		}
+	}
+	slices.Sort(timestamps)
+
+	gaps := make([]int64, 0, len(timestamps))
+	for i := 1; i < len(timestamps); i++ {
+		// Duplicate timestamps aren't a reporting interval
+		if gap := timestamps[i] - timestamps[i-1]; gap > 0 {
+			gaps = append(gaps, gap)
+		}
+	}
+	if len(gaps) == 0 {
+		return 0, false
+	}
+	slices.Sort(gaps)
+	return time.Duration(gaps[len(gaps)/2]) * time.Millisecond, true
+}
+
+// rawHistorical returns the most recent, up to limit, raw historical records' tempf and dateutc sorted by timestamp
+// ascending.
+func rawHistorical(ctx context.Context, records []map[string]any, limit int) []map[string]any {
+	samples := slices.SortedFunc(slices.Values(parseSamples(ctx, records, []string{"tempf"})), func(a, b historicalSample) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+	samples = samples[max(0, len(samples)-limit):]
+
+	raw := make([]map[string]any, 0, len(samples))
+	for _, sample := range samples {
+		raw = append(raw, map[string]any{"dateutc": sample.Timestamp, "tempf": sample.Values["tempf"]})
+	}
+	return raw
+}
+
+// coarseAndFineHistorical buckets the historical records twice, coarsely over the full window and finely over the
+// trailing fine window ending at the most recent record, for zoomed out and zoomed in graphs of the same data.
+func coarseAndFineHistorical(ctx context.Context, records []map[string]any, opts *DataFlags) ([]map[string]any, []map[string]any) {
+	coarseOpts := *opts
+	coarseOpts.BucketInterval, coarseOpts.HistoricalPoints = opts.CoarseInterval, 0
+	coarse, _ := bucketHistorical(ctx, records, &coarseOpts)
+
+	var endMs int64
+	for _, record := range records {
+		if timestampMs, ok := timestampField(record, "dateutc"); ok {
+			endMs = max(endMs, timestampMs)
+		}
+	}
+	startMs := endMs - opts.FineWindow.Milliseconds()
+	recent := make([]map[string]any, 0, len(records))
+	for _, record := range records {
+		if timestampMs, ok := timestampField(record, "dateutc"); ok && timestampMs > startMs {
+			recent = append(recent, record)
+		}
+	}
+
+	fineOpts := *opts
+	fineOpts.BucketInterval, fineOpts.HistoricalPoints = opts.FineInterval, 0
+	fine, _ := bucketHistorical(ctx, recent, &fineOpts)
+
+	slog.DebugContext(ctx, "bucketed coarse and fine historical data",
+		slog.Int("coarse_count", len(coarse)),
+		slog.Int("fine_count", len(fine)))
+	return coarse, fine
+}
+
+// averageLatest replaces the numeric latest fields with their average over the trailing window of raw historical
+// records ending at the latest reading, smoothing out noisy instantaneous readings. Timestamps, battery indicators
+// and rain fields aren't averaged.
+func averageLatest(ctx context.Context, latest map[string]any, records []map[string]any, opts *DataFlags) map[string]any {
+	window := opts.LatestAverage
+	endMs, ok := timestampField(latest, "dateutc")
+	if !ok {
+		endMs = time.Now().UnixMilli()
+	}
+	startMs := endMs - window.Milliseconds()
+	fields := smoothableFields(latest)
+
+	sums := make(map[string]float64, len(fields))
+	counts := make(map[string]int, len(fields))
+	for _, sample := range parseSamples(ctx, records, fields) {
+		if sample.Timestamp < startMs || sample.Timestamp > endMs {
+			continue
+		}
+		for field, value := range sample.Values {
+			sums[field] += value
+			counts[field]++
+		}
 	}
 
-	// Debug with limited output to reduce memory usage
-	slog.Debug("sending data to TRMNL",
-		slog.String("webhook", webhook.String()),
-		slog.Int("historical_count", len(data.MergeVariables.Historical)))
+	averaged := maps.Clone(latest)
+	for field, sum := range sums {
+		opts.setRounded(averaged, field, sum/float64(counts[field]))
+	}
+	slog.DebugContext(ctx, "averaged latest fields", slog.Duration("window", window), slog.Any("counts", counts))
+	return averaged
+}
+
+// smoothableFields returns the latest numeric fields which can be averaged over historical samples. Timestamps,
+// battery indicators and rain accumulations aren't.
+func smoothableFields(latest map[string]any) []string {
+	var fields []string
+	for field := range latest {
+		if field == "dateutc" || field == "lastRain" ||
+			isBatteryField(field) || strings.HasSuffix(field, "rainin") {
+			continue
+		}
+		if _, ok := float64Field(latest, field); ok {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
 
-	// Use a buffer pool for JSON marshaling
-	buffer := bytes.NewBuffer(make([]byte, 0, 8192)) // Pre-allocate a reasonable buffer size
-	encoder := json.NewEncoder(buffer)
-	if err := encoder.Encode(data); err != nil {
-		return fmt.Errorf("error marshaling webhook data: %w", err)
+// emaLatest replaces the latest numeric fields with their exponential moving average over the historical samples up
+// to the latest reading, oldest first, ending with the latest reading itself. Each sample is weighted by alpha and
+// the average so far by 1 - alpha, so an alpha of 2/(N+1) smooths about as much as averaging the last N samples,
+// e.g. 0.33 for 5 samples.
+func emaLatest(ctx context.Context, latest map[string]any, records []map[string]any, opts *DataFlags) map[string]any {
+	alpha := opts.LatestEmaAlpha
+	endMs, ok := timestampField(latest, "dateutc")
+	if !ok {
+		endMs = time.Now().UnixMilli()
 	}
+	fields := smoothableFields(latest)
 
-	// Log the size of the JSON payload
-	payloadSize := buffer.Len()
-	slog.Info("webhook payload details",
-		slog.Int("size_bytes", payloadSize),
-		slog.String("size_human", fmt.Sprintf("%.2f KB", float64(payloadSize)/1024)))
+	samples := parseSamples(ctx, records, fields)
+	slices.SortFunc(samples, func(a, b historicalSample) int { return cmp.Compare(a.Timestamp, b.Timestamp) })
 
-	// Send the HTTP POST request using the buffer directly
-	resp, err := http.Post(webhook.String(), "application/json", buffer)
+	averages := make(map[string]float64, len(fields))
+	counts := make(map[string]int, len(fields))
+	update := func(field string, value float64) {
+		if counts[field] == 0 {
+			averages[field] = value
+		} else {
+			averages[field] = alpha*value + (1-alpha)*averages[field]
+		}
+		counts[field]++
+	}
+	for _, sample := range samples {
+		// The latest reading is usually also the newest record, it's applied below instead
+		if sample.Timestamp >= endMs {
+			continue
+		}
+		for field, value := range sample.Values {
+			update(field, value)
+		}
+	}
+	for _, field := range fields {
+		if value, ok := float64Field(latest, field); ok {
+			update(field, value)
+		}
+	}
+
+	smoothed := maps.Clone(latest)
+	for field, average := range averages {
+		opts.setRounded(smoothed, field, average)
+	}
+	slog.DebugContext(ctx, "smoothed latest fields", slog.Float64("alpha", alpha), slog.Any("counts", counts))
+	return smoothed
+}
+
+// firstTimestamp returns the dateutc of the first of the records which has one.
+func firstTimestamp(records []map[string]any) (int64, bool) {
+	for _, record := range records {
+		if timestampMs, ok := timestampField(record, "dateutc"); ok {
+			return timestampMs, true
+		}
+	}
+	return 0, false
+}
+
+// padHistorical prepends copies of the latest reading, spaced the interval historical was bucketed at apart going
+// back in time, until there are MinHistorical records so that charts built from them don't break on a brand-new
+// station.
+func padHistorical(historical []map[string]any, latest map[string]any, interval time.Duration,
+	opts *DataFlags) []map[string]any {
+	intervalMs := interval.Milliseconds()
+
+	// Pad back in time from the earliest bucket, or from the latest reading's bucket when there are none. Bucket
+	// timestamps may be their first sample's rather than the interval start so round down to the interval.
+	var startMs int64
+	if earliestMs, ok := firstTimestamp(historical); ok {
+		startMs = (earliestMs / intervalMs) * intervalMs
+	} else {
+		latestMs, ok := timestampField(latest, "dateutc")
+		if !ok {
+			latestMs = time.Now().UnixMilli()
+		}
+		startMs = (latestMs/intervalMs)*intervalMs + intervalMs
+	}
+
+	fields := opts.effectiveFields(defaultHistoricalFields)
+	padCount := opts.MinHistorical - len(historical)
+	padded := make([]map[string]any, 0, opts.MinHistorical)
+	for i := padCount; i > 0; i-- {
+		record := make(map[string]any, len(fields)+1)
+		for _, field := range fields {
+			if value, ok := float64Field(latest, field); ok {
+				opts.setRounded(record, field, value)
+			}
+		}
+		record["dateutc"] = startMs - int64(i)*intervalMs
+		padded = append(padded, record)
+	}
+	return append(padded, historical...)
+}
+
+// Update fetches the latest data for the device and sends it to the webhook.
+func Update(ctx context.Context, key ambient.Key, mac string, opts *DataFlags, webhook *Webhook) error {
+	ctx = withCycleID(ctx)
+	start := time.Now()
+
+	data, err := Data(ctx, key, mac, opts)
 	if err != nil {
-		return fmt.Errorf("error sending webhook request: %w", err)
+		metrics.count("update.failure")
+		return err
+	}
+
+	if !webhook.ShouldSend(ctx, data) {
+		return nil
 	}
-	defer resp.Body.Close()
 
-	// Check response status efficiently
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		// Only read the body if there's an error
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)) // Limit body read
-		return fmt.Errorf("webhook request failed with status %d: %s", resp.StatusCode, body)
+	size, err := webhook.Send(ctx, data)
+	if err != nil {
+		metrics.count("update.failure")
+		return err
 	}
+	metrics.count("update.success")
+	metrics.timing("update.duration", time.Since(start))
+	metrics.gauge("webhook.payload_bytes", size)
 
-	slog.Info("webhook request sent successfully", slog.Int("status", resp.StatusCode))
+	slog.InfoContext(ctx, "update ok",
+		slog.String("device", mac),
+		slog.Any("latest_temp", data.MergeVariables.Latest["tempf"]),
+		slog.Int("historical", len(data.MergeVariables.Historical)),
+		slog.Int("bytes", size),
+		slog.Int64("dur_ms", time.Since(start).Milliseconds()))
 	return nil
 }
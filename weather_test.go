@@ -0,0 +1,428 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testEpochMs is an hour boundary well in the past so no test bucket is the current, still filling, one.
+const testEpochMs = int64(1700002800000)
+
+// testDataFlags returns data flags with the command line defaults that bucketing depends on.
+func testDataFlags() *DataFlags {
+	return &DataFlags{
+		BucketInterval:   time.Hour,
+		BucketTimestamp:  bucketTimestampStart,
+		HistoricalOrder:  historicalOrderAsc,
+		DefaultPrecision: 1,
+		Rounding:         roundingNearest,
+		MinBucketSamples: 1,
+		Timezone:         "UTC",
+	}
+}
+
+// testRecord returns a raw historical record with the given dateutc and tempf.
+func testRecord(dateutc any, tempf float64) map[string]any {
+	return map[string]any{"dateutc": dateutc, "tempf": tempf}
+}
+
+// timestamps returns the dateutc of each record.
+func timestamps(t *testing.T, records []map[string]any) []int64 {
+	t.Helper()
+	starts := make([]int64, 0, len(records))
+	for _, record := range records {
+		ms, ok := timestampField(record, "dateutc")
+		if !ok {
+			t.Fatalf("record without dateutc: %v", record)
+		}
+		starts = append(starts, ms)
+	}
+	return starts
+}
+
+func TestRoundToNeverNegativeZero(t *testing.T) {
+	tests := []struct {
+		name   string
+		v      float64
+		places int
+		mode   string
+		want   float64
+	}{
+		{"nearest small negative", -0.04, 1, roundingNearest, 0},
+		{"nearest negative zero", math.Copysign(0, -1), 1, roundingNearest, 0},
+		{"ceil small negative", -0.04, 1, roundingCeil, 0},
+		{"nearest whole", -0.4, 0, roundingNearest, 0},
+		{"negative kept", -0.06, 1, roundingNearest, -0.1},
+		{"floor small positive", 0.04, 1, roundingFloor, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := roundTo(tt.v, tt.places, tt.mode)
+			if got != tt.want || math.Signbit(got) != math.Signbit(tt.want) {
+				t.Errorf("roundTo(%v, %d, %q) = %v, want %v", tt.v, tt.places, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketHistoricalStableOrder(t *testing.T) {
+	hour := time.Hour.Milliseconds()
+	// Newest first like the API, with duplicate timestamps within and across buckets
+	records := []map[string]any{
+		testRecord(float64(testEpochMs+2*hour+60000), 50),
+		testRecord(float64(testEpochMs+2*hour+60000), 52),
+		testRecord(float64(testEpochMs+hour), 40),
+		testRecord(float64(testEpochMs+hour), 40),
+		testRecord(float64(testEpochMs), 30),
+		testRecord(float64(testEpochMs), 32),
+	}
+	want := []map[string]any{
+		{"dateutc": testEpochMs, "tempf": 31.0},
+		{"dateutc": testEpochMs + hour, "tempf": 40.0},
+		{"dateutc": testEpochMs + 2*hour, "tempf": 51.0},
+	}
+
+	for range 50 {
+		got, _ := bucketHistorical(context.Background(), records, testDataFlags())
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("bucketHistorical() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestHistoricalOrder(t *testing.T) {
+	hour := time.Hour.Milliseconds()
+	records := []map[string]any{
+		testRecord(float64(testEpochMs+2*hour), 50),
+		testRecord(float64(testEpochMs+hour), 40),
+		testRecord(float64(testEpochMs), 30),
+	}
+	latest := testRecord(float64(testEpochMs+2*hour), 50)
+	ascending := []int64{testEpochMs, testEpochMs + hour, testEpochMs + 2*hour}
+	descending := []int64{testEpochMs + 2*hour, testEpochMs + hour, testEpochMs}
+
+	tests := []struct {
+		order string
+		want  []int64
+	}{
+		{historicalOrderAsc, ascending},
+		{historicalOrderDesc, descending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			opts := testDataFlags()
+			opts.HistoricalOrder = tt.order
+			opts.HistoricalRaw = true
+			opts.HistoricalRawMax = 10
+
+			mv := newWebhookData(context.Background(), latest, latest, records, opts).MergeVariables
+			if got := timestamps(t, mv.Historical); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("historical dateutc = %v, want %v", got, tt.want)
+			}
+			if got := timestamps(t, mv.HistoricalRaw); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("historicalRaw dateutc = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreciseRecordsKeepInt64Precision(t *testing.T) {
+	// Beyond 2^53 so float64 can't represent it exactly
+	const dateutc = int64(9007199254740993)
+	body := []byte(`[{"dateutc": 9007199254740993, "tempf": 72.1}]`)
+	fallback := []map[string]any{{"dateutc": float64(dateutc), "tempf": 72.1}}
+
+	records := preciseRecords(context.Background(), body, fallback)
+	if got, ok := timestampField(records[0], "dateutc"); !ok || got != dateutc {
+		t.Errorf("dateutc = %d, want %d", got, dateutc)
+	}
+	if got, ok := float64Field(records[0], "tempf"); !ok || got != 72.1 {
+		t.Errorf("tempf = %v, want 72.1", got)
+	}
+
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"malformed body", []byte(`not json`)},
+		{"record count mismatch", []byte(`[]`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := preciseRecords(context.Background(), tt.body, fallback); !reflect.DeepEqual(got, fallback) {
+				t.Errorf("preciseRecords() = %v, want the fallback %v", got, fallback)
+			}
+		})
+	}
+}
+
+func TestBucketHistoricalMinBucketSamples(t *testing.T) {
+	hour := time.Hour.Milliseconds()
+	// One, two and three samples in consecutive buckets
+	records := []map[string]any{
+		testRecord(float64(testEpochMs+2*hour+120000), 50),
+		testRecord(float64(testEpochMs+2*hour+60000), 50),
+		testRecord(float64(testEpochMs+2*hour), 50),
+		testRecord(float64(testEpochMs+hour+60000), 40),
+		testRecord(float64(testEpochMs+hour), 40),
+		testRecord(float64(testEpochMs), 30),
+	}
+
+	tests := []struct {
+		minSamples int
+		want       []int64
+	}{
+		{0, []int64{testEpochMs, testEpochMs + hour, testEpochMs + 2*hour}},
+		{1, []int64{testEpochMs, testEpochMs + hour, testEpochMs + 2*hour}},
+		{2, []int64{testEpochMs + hour, testEpochMs + 2*hour}},
+		{3, []int64{testEpochMs + 2*hour}},
+		{4, []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.minSamples), func(t *testing.T) {
+			opts := testDataFlags()
+			opts.MinBucketSamples = tt.minSamples
+			got, _ := bucketHistorical(context.Background(), records, opts)
+			if starts := timestamps(t, got); !reflect.DeepEqual(starts, tt.want) {
+				t.Errorf("bucket dateutc = %v, want %v", starts, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketHistoricalSortsStringTimestampsNumerically(t *testing.T) {
+	// Hour boundaries either side of 10^12 ms, which sort the other way round as strings
+	const short, long = int64(999997200000), int64(1000000800000)
+
+	tests := []struct {
+		name    string
+		records []map[string]any
+	}{
+		{"strings", []map[string]any{testRecord("999997200000", 30), testRecord("1000000800000", 40)}},
+		{"padded strings", []map[string]any{testRecord(" 1000000800000", 40), testRecord("999997200000 ", 30)}},
+		{"mixed", []map[string]any{testRecord("1000000800000", 40), testRecord(float64(short), 30)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := bucketHistorical(context.Background(), tt.records, testDataFlags())
+			if starts := timestamps(t, got); !reflect.DeepEqual(starts, []int64{short, long}) {
+				t.Errorf("bucket dateutc = %v, want %v", starts, []int64{short, long})
+			}
+		})
+	}
+}
+
+func TestPadHistorical(t *testing.T) {
+	hour := time.Hour.Milliseconds()
+	latest := testRecord(float64(testEpochMs+30*60000), 60)
+
+	tests := []struct {
+		name          string
+		records       []map[string]any
+		minHistorical int
+		points        uint
+		want          []int64
+		padded        int
+	}{
+		{
+			name:          "no records",
+			minHistorical: 3,
+			want:          []int64{testEpochMs - 2*hour, testEpochMs - hour, testEpochMs},
+			padded:        3,
+		},
+		{
+			name:          "enough records",
+			records:       []map[string]any{testRecord(float64(testEpochMs+hour), 40), testRecord(float64(testEpochMs), 30)},
+			minHistorical: 2,
+			want:          []int64{testEpochMs, testEpochMs + hour},
+		},
+		{
+			name:          "one bucket",
+			records:       []map[string]any{testRecord(float64(testEpochMs), 30)},
+			minHistorical: 3,
+			want:          []int64{testEpochMs - 2*hour, testEpochMs - hour, testEpochMs},
+			padded:        2,
+		},
+		{
+			// Four hours of samples in two points are bucketed, and so padded, two hours apart
+			name: "historical points",
+			records: []map[string]any{
+				testRecord(float64(testEpochMs+4*hour), 50),
+				testRecord(float64(testEpochMs+3*hour), 45),
+				testRecord(float64(testEpochMs+2*hour), 40),
+				testRecord(float64(testEpochMs+hour), 35),
+				testRecord(float64(testEpochMs), 30),
+			},
+			minHistorical: 5,
+			points:        2,
+			want: []int64{
+				testEpochMs - 5*hour, testEpochMs - 3*hour, testEpochMs - hour, testEpochMs + hour, testEpochMs + 3*hour,
+			},
+			padded: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testDataFlags()
+			opts.MinHistorical = tt.minHistorical
+			opts.HistoricalPoints = tt.points
+
+			historical := newWebhookData(context.Background(), latest, latest, tt.records, opts).MergeVariables.Historical
+			if got := timestamps(t, historical); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("historical dateutc = %v, want %v", got, tt.want)
+			}
+			for _, record := range historical[:tt.padded] {
+				if record["tempf"] != 60.0 {
+					t.Errorf("padded tempf = %v, want the latest 60", record["tempf"])
+				}
+			}
+		})
+	}
+}
+
+func TestNewWebhookDataHistoricalSorted(t *testing.T) {
+	hour := time.Hour.Milliseconds()
+	// Newest first like the API, with a few readings out of order
+	records := []map[string]any{
+		testRecord(float64(testEpochMs+3*hour+600000), 52),
+		testRecord(float64(testEpochMs+3*hour), 50),
+		testRecord(float64(testEpochMs+hour), 40),
+		testRecord(float64(testEpochMs+2*hour+1800000), 46),
+		testRecord(float64(testEpochMs+2*hour), 44),
+		testRecord(float64(testEpochMs), 30),
+	}
+	latest := testRecord(float64(testEpochMs+3*hour+600000), 52)
+
+	tests := []struct {
+		order string
+		cmp   func(a, b int64) int
+	}{
+		{historicalOrderAsc, cmp.Compare[int64]},
+		{historicalOrderDesc, func(a, b int64) int { return cmp.Compare(b, a) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			opts := testDataFlags()
+			opts.HistoricalOrder = tt.order
+			opts.LatestAverage = 30 * time.Minute
+			opts.MinHistorical = 8
+			opts.FineWindow = 2 * time.Hour
+			opts.FineInterval = 30 * time.Minute
+			opts.CoarseInterval = 2 * time.Hour
+			opts.HistoricalRaw = true
+			opts.HistoricalRawMax = 10
+
+			mv := newWebhookData(context.Background(), latest, latest, records, opts).MergeVariables
+			if len(mv.Historical) != opts.MinHistorical {
+				t.Errorf("historical has %d records, want %d padded", len(mv.Historical), opts.MinHistorical)
+			}
+			series := map[string][]map[string]any{
+				"historical":       mv.Historical,
+				"historicalCoarse": mv.HistoricalCoarse,
+				"historicalFine":   mv.HistoricalFine,
+				"historicalRaw":    mv.HistoricalRaw,
+			}
+			for name, records := range series {
+				if len(records) == 0 {
+					t.Errorf("%s is empty", name)
+				}
+				if got := timestamps(t, records); !slices.IsSortedFunc(got, tt.cmp) {
+					t.Errorf("%s dateutc = %v, not sorted %s", name, got, tt.order)
+				}
+			}
+		})
+	}
+}
+
+func TestBucketHistoricalSmallN(t *testing.T) {
+	hour := time.Hour.Milliseconds()
+
+	tests := []struct {
+		name    string
+		records []map[string]any
+		want    []map[string]any
+	}{
+		{"no records", []map[string]any{}, []map[string]any{}},
+		{"nil records", nil, []map[string]any{}},
+		{
+			"one record",
+			[]map[string]any{testRecord(float64(testEpochMs+600000), 30)},
+			[]map[string]any{{"dateutc": testEpochMs, "tempf": 30.0}},
+		},
+		{
+			"few records",
+			[]map[string]any{
+				testRecord(float64(testEpochMs+5*hour), 50),
+				testRecord(float64(testEpochMs+hour+600000), 41),
+				testRecord(float64(testEpochMs+hour), 40),
+			},
+			[]map[string]any{
+				{"dateutc": testEpochMs + hour, "tempf": 40.5},
+				{"dateutc": testEpochMs + 5*hour, "tempf": 50.0},
+			},
+		},
+		{
+			"unparseable records",
+			[]map[string]any{{"dateutc": "soon", "tempf": 30.0}, {"tempf": 31.0}},
+			[]map[string]any{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testDataFlags()
+			// Far more than the records received, as for a new station
+			opts.ResultsLimit = 288
+			got, _ := bucketHistorical(context.Background(), tt.records, opts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bucketHistorical() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketTimestamp(t *testing.T) {
+	hour, minute := time.Hour.Milliseconds(), time.Minute.Milliseconds()
+	// Irregular readings, newest first like the API
+	records := []map[string]any{
+		testRecord(float64(testEpochMs+3*hour+minute), 50),
+		testRecord(float64(testEpochMs+hour+55*minute), 41),
+		testRecord(float64(testEpochMs+hour+5*minute), 40),
+		testRecord(float64(testEpochMs+42*minute), 33),
+		testRecord(float64(testEpochMs+17*minute), 31),
+	}
+	latest := testRecord(float64(testEpochMs+3*hour+minute), 50)
+	// Padding lines up with the interval whichever timestamp the buckets have
+	padding := []int64{testEpochMs - 2*hour, testEpochMs - hour}
+
+	tests := []struct {
+		timestamp string
+		want      []int64
+	}{
+		{bucketTimestampStart, []int64{testEpochMs, testEpochMs + hour, testEpochMs + 3*hour}},
+		{bucketTimestampFirstSample, []int64{testEpochMs + 17*minute, testEpochMs + hour + 5*minute, testEpochMs + 3*hour + minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.timestamp, func(t *testing.T) {
+			opts := testDataFlags()
+			opts.BucketTimestamp = tt.timestamp
+
+			got, _ := bucketHistorical(context.Background(), records, opts)
+			if starts := timestamps(t, got); !reflect.DeepEqual(starts, tt.want) {
+				t.Errorf("bucket dateutc = %v, want %v", starts, tt.want)
+			}
+
+			opts.MinHistorical = 5
+			historical := newWebhookData(context.Background(), latest, latest, records, opts).MergeVariables.Historical
+			want := append(slices.Clone(padding), tt.want...)
+			if got := timestamps(t, historical); !reflect.DeepEqual(got, want) {
+				t.Errorf("padded dateutc = %v, want %v", got, want)
+			}
+		})
+	}
+}
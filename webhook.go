@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+// deepMergeStrategy asks TRMNL to merge sent variables into the ones it already has rather than replace them.
+const deepMergeStrategy = "deep_merge"
+
+// Webhook delivers WebhookData to a TRMNL private plugin webhook URL and, or, writes it to a file.
+type Webhook struct {
+	// Client sends webhook requests, the default client when nil.
+	Client *http.Client
+	// URL is the webhook URL, nil when data is only written to OutputFile.
+	URL    *url.URL
+	Method string
+	// Format is the payload format data is encoded in, see encodePayload.
+	Format payloadFormat
+	// Encoding is how the payload is sent in the request body, either as JSON or as a "payload" form value.
+	Encoding string
+	// Retries is how many times a transient transport error is retried, waiting RetryDelay and doubling it each time.
+	Retries    int
+	RetryDelay time.Duration
+	// DeltaOnly sends only the latest fields which changed since the last successful send.
+	DeltaOnly bool
+	// Refetch, when set, is called before each retry so fresh data is sent rather than resending the original.
+	Refetch func(ctx context.Context) (*WebhookData, error)
+	// Device identifies the data's source in idempotency keys, see idempotencyKey.
+	Device string
+	// IdempotencyKey sends an Idempotency-Key header so receivers can drop retried duplicates.
+	IdempotencyKey bool
+	// DumpPayloadOnError, when set, is a directory the payload and response are saved to when the webhook rejects it.
+	DumpPayloadOnError string
+	// PostWhen are conditions the latest data must all meet for it to be sent, see ShouldSend.
+	PostWhen []condition
+	// OutputFile, when set, is overwritten with the full payload on every send, e.g. for another process to deliver.
+	OutputFile string
+
+	lastLatest map[string]any
+	// lastSent is the data most recently sent successfully, before any delta was taken of it.
+	lastSent *WebhookData
+}
+
+// TRMNL cloud webhook URLs are https://usetrmnl.com/api/custom_plugins/<uuid> whereas self-hosted BYOS servers
+// conventionally expose merge variables at /api/custom_plugins/<id>/merge_variables on their own host.
+var (
+	cloudWebhookPath = regexp.MustCompile(`^/api/custom_plugins/[^/]+/?$`)
+	byosWebhookPath  = regexp.MustCompile(`^/api/custom_plugins/[^/]+/merge_variables/?$`)
+)
+
+const cloudWebhookHost = "usetrmnl.com"
+
+// webhookPluginID matches the plugin ID in a webhook URL's path, which is all it takes to post to the plugin.
+var webhookPluginID = regexp.MustCompile(`(/custom_plugins/)[^/]+`)
+
+// redactWebhookURL returns u for logging with its plugin ID, password and query values replaced by "xxxxx".
+// url.URL's Redacted only hides the password, which TRMNL webhook URLs don't have.
+func redactWebhookURL(u *url.URL) string {
+	redacted := *u
+	redacted.Path = webhookPluginID.ReplaceAllString(u.Path, "${1}xxxxx")
+	redacted.RawPath = ""
+	if query := u.Query(); len(query) > 0 {
+		for name := range query {
+			query[name] = []string{"xxxxx"}
+		}
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.Redacted()
+}
+
+// checkWebhookURL returns an error describing how u differs from the expected TRMNL cloud, or BYOS, webhook URL.
+func checkWebhookURL(u *url.URL, byos bool) error {
+	if byos {
+		if u.Hostname() == cloudWebhookHost {
+			return errors.New("--byos is set but the URL is TRMNL cloud's")
+		}
+		if !byosWebhookPath.MatchString(u.Path) {
+			return fmt.Errorf("expected a BYOS path like /api/custom_plugins/<id>/merge_variables, got %q", u.Path)
+		}
+		return nil
+	}
+
+	if u.Hostname() != cloudWebhookHost {
+		return fmt.Errorf("expected host %s, set --byos for self-hosted servers", cloudWebhookHost)
+	}
+	if !cloudWebhookPath.MatchString(u.Path) {
+		return fmt.Errorf("expected a path like /api/custom_plugins/<uuid>, got %q", u.Path)
+	}
+	return nil
+}
+
+// Payload encodings selectable with --payload-encoding.
+const (
+	payloadEncodingJSON = "json"
+	payloadEncodingForm = "form"
+)
+
+// Send marshals data to JSON and sends it to the webhook URL, returning the size of the sent payload in bytes.
+func (w *Webhook) Send(ctx context.Context, data *WebhookData) (int, error) {
+	if w.OutputFile != "" {
+		size, err := writePayloadFile(w.OutputFile, data, w.Format)
+		if err != nil {
+			return 0, err
+		}
+		slog.DebugContext(ctx, "wrote payload file", slog.String("path", w.OutputFile), slog.Int("size_bytes", size))
+		if w.URL == nil {
+			w.lastSent = data
+			return size, nil
+		}
+	}
+
+	sent := data
+	body, contentType, err := w.encode(ctx, data)
+	if err != nil {
+		return 0, err
+	}
+
+	// Every attempt shares the key, even with refetched data, so the receiver sees retries as one delivery
+	var key string
+	if w.IdempotencyKey {
+		key = w.idempotencyKey(data)
+	}
+
+	// Retry transient transport errors, e.g. a DNS hiccup or connection reset, but fail fast on permanent ones
+	delay := w.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := w.post(ctx, body, contentType, key)
+		if err == nil {
+			break
+		}
+		// The webhook responded so there's nothing wrong with the transport, leave it to the next update
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			if w.DumpPayloadOnError != "" {
+				dumpRejectedPayload(ctx, w.DumpPayloadOnError, body, statusErr)
+			}
+			return 0, err
+		}
+		if !isTransient(err) {
+			return 0, fmt.Errorf("webhook request failed permanently, check the webhook URL: %w", err)
+		}
+		if attempt >= w.Retries {
+			return 0, err
+		}
+		slog.WarnContext(ctx, "transient webhook error, retrying",
+			slog.String("err", err.Error()),
+			slog.Int("attempt", attempt+1),
+			slog.Duration("delay", delay))
+		if err := sleep(ctx, delay); err != nil {
+			return 0, err
+		}
+		delay *= 2
+
+		if w.Refetch != nil {
+			// Waiting for the delay above also lets the Ambient Weather rate limit reset
+			fresh, err := w.Refetch(ctx)
+			if err != nil {
+				slog.WarnContext(ctx, "could not refetch data for retry, resending original", slog.String("err", err.Error()))
+				continue
+			}
+			freshBody, freshContentType, err := w.encode(ctx, fresh)
+			if err != nil {
+				return 0, err
+			}
+			sent, body, contentType = fresh, freshBody, freshContentType
+		}
+	}
+
+	w.lastLatest, w.lastSent = sent.MergeVariables.Latest, sent
+	return len(body), nil
+}
+
+// encode returns the request body and its content type for data.
+func (w *Webhook) encode(ctx context.Context, data *WebhookData) ([]byte, string, error) {
+	if w.DeltaOnly {
+		data = w.delta(ctx, data)
+	}
+
+	// Debug with limited output to reduce memory usage
+	slog.DebugContext(ctx, "sending data to TRMNL",
+		slog.String("webhook", redactWebhookURL(w.URL)),
+		slog.String("method", w.Method),
+		slog.Int("historical_count", len(data.MergeVariables.Historical)))
+
+	// Use a buffer pool for JSON marshaling
+	buffer := bytes.NewBuffer(make([]byte, 0, 8192)) // Pre-allocate a reasonable buffer size
+	if err := encodePayload(buffer, data, w.Format); err != nil {
+		return nil, "", fmt.Errorf("error marshaling webhook data: %w", err)
+	}
+
+	body, contentType := buffer.Bytes(), "application/json"
+	if w.Encoding == payloadEncodingForm {
+		// Legacy receivers expect the JSON as a form value
+		body = []byte(url.Values{"payload": {buffer.String()}}.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	}
+
+	// Log the size of the payload
+	payloadSize := len(body)
+	slog.DebugContext(ctx, "webhook payload details",
+		slog.Int("size_bytes", payloadSize),
+		slog.String("size_human", fmt.Sprintf("%.2f KB", float64(payloadSize)/1024)))
+
+	return body, contentType, nil
+}
+
+// ShouldSend reports whether data's latest reading meets every PostWhen condition, logging the first one which isn't.
+func (w *Webhook) ShouldSend(ctx context.Context, data *WebhookData) bool {
+	for _, c := range w.PostWhen {
+		if !c.holds(data.MergeVariables.Latest) {
+			slog.InfoContext(ctx, "skipping send, condition not met",
+				slog.String("condition", c.String()),
+				slog.Any("value", data.MergeVariables.Latest[c.Field]))
+			return false
+		}
+	}
+	return true
+}
+
+// Ping sends a harmless payload to the webhook URL, empty merge variables deep merged into the existing ones, so a
+// misconfigured webhook is caught before the first update. It isn't retried. It's skipped for the bare shape, which has no
+// merge strategy, since any payload would replace the receiver's existing data.
+func (w *Webhook) Ping(ctx context.Context) error {
+	if w.URL == nil {
+		return nil
+	}
+	if w.Format.Shape == payloadShapeBare {
+		slog.WarnContext(ctx, "skipping webhook verification, it's only supported for the wrapped payload shape")
+		return nil
+	}
+
+	payload := map[string]any{"merge_variables": map[string]any{}, "merge_strategy": deepMergeStrategy}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling webhook ping: %w", err)
+	}
+	contentType := "application/json"
+	if w.Encoding == payloadEncodingForm {
+		body = []byte(url.Values{"payload": {string(body)}}.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	}
+
+	if err := w.post(ctx, body, contentType, ""); err != nil {
+		return fmt.Errorf("webhook verification failed: %w", err)
+	}
+	slog.InfoContext(ctx, "verified webhook", slog.String("webhook", redactWebhookURL(w.URL)))
+	return nil
+}
+
+// dumpRejectedPayload saves a payload the webhook rejected, exactly as sent, to a timestamped file in dir alongside a
+// file with the response status and body. Failing to save them is logged rather than failing the update further.
+func dumpRejectedPayload(ctx context.Context, dir string, body []byte, statusErr *StatusError) {
+	prefix := filepath.Join(dir, time.Now().UTC().Format("20060102T150405.000Z")+"-webhook")
+	response := fmt.Appendf(nil, "%d %s\n\n%s", statusErr.StatusCode, http.StatusText(statusErr.StatusCode), statusErr.Body)
+
+	err := os.MkdirAll(dir, 0o755)
+	if err == nil {
+		err = os.WriteFile(prefix+"-payload", body, 0o644)
+	}
+	if err == nil {
+		err = os.WriteFile(prefix+"-response", response, 0o644)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "could not dump rejected webhook payload", slog.String("dir", dir), slog.String("err", err.Error()))
+		return
+	}
+	slog.InfoContext(ctx, "dumped rejected webhook payload", slog.String("path", prefix+"-payload"))
+}
+
+// idempotencyKey returns a key identifying data by its device and latest reading's timestamp, so it's stable across
+// retries of an update but differs for the next update's new reading. Without a reading timestamp, e.g. when dateutc
+// is excluded, the time the key is made stands in for it so separate updates aren't mistaken for retries. Send makes
+// the key once per update.
+func (w *Webhook) idempotencyKey(data *WebhookData) string {
+	id := "dateutc"
+	dateutc, ok := timestampField(data.MergeVariables.Latest, "dateutc")
+	if !ok {
+		id, dateutc = "sent", time.Now().UnixNano()
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s-%s-%d", w.Device, id, dateutc))
+	return hex.EncodeToString(sum[:16])
+}
+
+// post sends a single webhook request with the given body and, when not empty, idempotency key.
+func (w *Webhook) post(ctx context.Context, body []byte, contentType, key string) error {
+	req, err := http.NewRequestWithContext(ctx, w.Method, w.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	metrics.timing("webhook.latency", time.Since(start))
+	if err != nil {
+		return fmt.Errorf("error sending webhook request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status efficiently
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// Only read the body if there's an error
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)) // Limit body read
+		return &StatusError{StatusCode: resp.StatusCode, Body: body}
+	}
+
+	slog.DebugContext(ctx, "webhook request sent successfully", slog.Int("status", resp.StatusCode))
+	return nil
+}
+
+// StatusError is returned when the webhook responds with a non-2xx status code.
+type StatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+// isTransient reports whether a webhook transport error is likely to succeed if retried. Timeouts, temporary DNS
+// failures and dropped connections are transient whereas an unknown host, e.g. a typo in the webhook URL, is not.
+func isTransient(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// delta returns a copy of data whose latest fields only include those that changed since the last successful send.
+// The dateutc field is always included. TRMNL is asked to deep merge so that omitted fields retain their values.
+func (w *Webhook) delta(ctx context.Context, data *WebhookData) *WebhookData {
+	if w.lastLatest == nil {
+		// Nothing has been sent yet so everything has changed
+		return &WebhookData{MergeVariables: data.MergeVariables, MergeStrategy: deepMergeStrategy}
+	}
+
+	changed := make(map[string]any, len(data.MergeVariables.Latest))
+	for field, value := range data.MergeVariables.Latest {
+		if previous, exists := w.lastLatest[field]; field == "dateutc" || !exists || !reflect.DeepEqual(previous, value) {
+			changed[field] = value
+		}
+	}
+	slog.DebugContext(ctx, "delta latest fields",
+		slog.Int("changed_count", len(changed)),
+		slog.Int("total_count", len(data.MergeVariables.Latest)))
+
+	// Everything but the latest fields is sent as is so derived values don't go stale on the display
+	mv := data.MergeVariables
+	mv.Latest = changed
+	return &WebhookData{MergeVariables: mv, MergeStrategy: deepMergeStrategy}
+}